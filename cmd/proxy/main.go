@@ -1,18 +1,29 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"log"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/autoslides/video-proxy/internal/archive"
+	"github.com/autoslides/video-proxy/internal/auth"
+	"github.com/autoslides/video-proxy/internal/cache"
 	"github.com/autoslides/video-proxy/internal/config"
 	"github.com/autoslides/video-proxy/internal/crypto"
 	"github.com/autoslides/video-proxy/internal/handler"
 	"github.com/autoslides/video-proxy/internal/mapping"
+	"github.com/autoslides/video-proxy/internal/metrics"
 	"github.com/autoslides/video-proxy/internal/proxy"
+	"github.com/autoslides/video-proxy/internal/ratelimit"
 	"github.com/autoslides/video-proxy/internal/token"
 )
 
@@ -30,16 +41,76 @@ func main() {
 		log.Fatalf("Failed to load intranet mappings: %v", err)
 	}
 
+	// Initialize admin API authentication
+	authenticator, err := auth.New(cfg.AdminKeysFile)
+	if err != nil {
+		log.Fatalf("Failed to load admin keys: %v", err)
+	}
+
 	// Initialize components
 	cryptoService := crypto.New(cfg.MagicKey)
-	tokenCache := token.NewCache(cfg.UpstreamAPI, cfg.MagicKey)
-	proxyClient := proxy.NewClient(cfg.RequestTimeout, cfg.IntranetTimeout, mapper)
+	externalTransport := proxy.NewTransport(transportConfig(cfg.Transport, cfg.RequestTimeout), false)
+	intranetTransport := proxy.NewTransport(transportConfig(cfg.Transport, cfg.IntranetTimeout), true)
+	tokenCache := token.NewCache(cfg.UpstreamAPI, cfg.MagicKey, externalTransport)
+	proxyClient := proxy.NewClient(cfg.RequestIdle, cfg.IntranetIdle, externalTransport, intranetTransport, mapper)
+	proxyClient.SetRetryPolicies(cfg.ExternalRetry, cfg.IntranetRetry)
+	proxyClient.SetBreakerConfig(cfg.Breaker)
+	proxyClient.SetHedgeDelay(cfg.HedgeDelay)
 
 	// Initialize handlers
 	healthHandler := handler.NewHealthHandler()
 	streamHandler := handler.NewStreamHandler(cryptoService, tokenCache, proxyClient, cfg.VideoHost)
 	segmentHandler := handler.NewSegmentHandler(cryptoService, tokenCache, proxyClient, cfg.VideoHost)
+	downloadHandler := handler.NewDownloadHandler(cryptoService, tokenCache, proxyClient, cfg.VideoHost)
+	audioHandler := handler.NewAudioHandler(cryptoService, tokenCache, proxyClient, cfg.VideoHost)
 	configHandler := handler.NewConfigHandler(mapper)
+	breakerHandler := handler.NewBreakerHandler(proxyClient)
+
+	autoPreferExternal := cfg.AutoPrefer == "external"
+	streamHandler.SetAutoPreferExternal(autoPreferExternal)
+	segmentHandler.SetAutoPreferExternal(autoPreferExternal)
+	downloadHandler.SetAutoPreferExternal(autoPreferExternal)
+	audioHandler.SetAutoPreferExternal(autoPreferExternal)
+
+	// Segment prefetching (nil when disabled)
+	segmentCache := cache.New(cfg.SegmentCache, cfg.SegmentCacheTTL)
+	prefetcher := handler.NewPrefetcher(
+		cryptoService, tokenCache, proxyClient, cfg.VideoHost, segmentCache,
+		cfg.Prefetch.Segments, cfg.Prefetch.Concurrency, cfg.Prefetch.IdleTimeout,
+	)
+	if prefetcher != nil {
+		prefetcher.SetAutoPreferExternal(autoPreferExternal)
+		streamHandler.SetPrefetcher(prefetcher)
+		segmentHandler.SetPrefetcher(prefetcher)
+	}
+
+	// Lecture archive (nil when disabled)
+	archiveFetcher := handler.NewArchiveFetcher(cryptoService, tokenCache, proxyClient, cfg.VideoHost)
+	archiveFetcher.SetAutoPreferExternal(autoPreferExternal)
+	lectureArchive, err := archive.New(
+		cfg.Archive.Dir, archiveFetcher, cfg.Archive.Concurrency, cfg.Archive.SegmentConcurrency,
+	)
+	if err != nil {
+		log.Fatalf("Failed to open archive: %v", err)
+	}
+	if lectureArchive != nil {
+		log.Printf("Archive directory: %s", cfg.Archive.Dir)
+		streamHandler.SetArchive(lectureArchive)
+		segmentHandler.SetArchive(lectureArchive)
+	}
+
+	if cfg.LiveAccumulate {
+		streamHandler.SetLiveAccumulator(handler.NewLiveAccumulator(cfg.LiveTTL))
+	}
+
+	throttle := ratelimit.NewThrottle(
+		cfg.ConnBandwidth,
+		cfg.TokenBandwidth,
+		cfg.GlobalBandwidth,
+	)
+	segmentHandler.SetThrottle(throttle)
+	downloadHandler.SetThrottle(throttle)
+	audioHandler.SetThrottle(throttle)
 
 	// Set up SIGHUP handler for config reload
 	sigChan := make(chan os.Signal, 1)
@@ -52,9 +123,17 @@ func main() {
 			} else {
 				log.Println("Mappings reloaded successfully")
 			}
+			if err := authenticator.Reload(); err != nil {
+				log.Printf("Failed to reload admin keys: %v", err)
+			}
 		}
 	}()
 
+	// Per-client rate limiters (nil when disabled)
+	keyFunc := ratelimit.NewKeyFunc(cfg.RateLimitKey, cfg.TrustForwarded)
+	streamLimiter := ratelimit.NewLimiter("stream", cfg.StreamRateLimit.Rate, cfg.StreamRateLimit.Burst, keyFunc)
+	segmentLimiter := ratelimit.NewLimiter("ts", cfg.SegmentRateLimit.Rate, cfg.SegmentRateLimit.Burst, keyFunc)
+
 	// Set up HTTP routes
 	mux := http.NewServeMux()
 
@@ -62,32 +141,152 @@ func main() {
 	mux.Handle("/health", healthHandler)
 
 	// Stream endpoints (path-based routing for network mode)
-	mux.HandleFunc("/external/stream", streamHandler.ServeHTTP)
-	mux.HandleFunc("/intranet/stream", streamHandler.ServeHTTP)
+	mux.Handle("/external/stream", streamLimiter.Middleware(streamHandler))
+	mux.Handle("/intranet/stream", streamLimiter.Middleware(streamHandler))
+	mux.Handle("/auto/stream", streamLimiter.Middleware(streamHandler))
 
 	// TS segment endpoints
-	mux.HandleFunc("/external/ts/", segmentHandler.ServeHTTP)
-	mux.HandleFunc("/intranet/ts/", segmentHandler.ServeHTTP)
+	mux.Handle("/external/ts/", segmentLimiter.Middleware(segmentHandler))
+	mux.Handle("/intranet/ts/", segmentLimiter.Middleware(segmentHandler))
+	mux.Handle("/auto/ts/", segmentLimiter.Middleware(segmentHandler))
+
+	// Whole-lecture downloads
+	mux.Handle("/external/download", streamLimiter.Middleware(downloadHandler))
+	mux.Handle("/intranet/download", streamLimiter.Middleware(downloadHandler))
+	mux.Handle("/auto/download", streamLimiter.Middleware(downloadHandler))
+
+	// Playlist metadata as JSON
+	infoHandler := handler.NewInfoHandler(streamHandler)
+	mux.Handle("/external/info", streamLimiter.Middleware(infoHandler))
+	mux.Handle("/intranet/info", streamLimiter.Middleware(infoHandler))
+	mux.Handle("/auto/info", streamLimiter.Middleware(infoHandler))
+
+	// Playback position to segment
+	seekHandler := handler.NewSeekHandler(streamHandler)
+	mux.Handle("/external/seek", streamLimiter.Middleware(seekHandler))
+	mux.Handle("/intranet/seek", streamLimiter.Middleware(seekHandler))
+	mux.Handle("/auto/seek", streamLimiter.Middleware(seekHandler))
+
+	// Several sessions stitched into one playlist
+	stitchHandler := handler.NewStitchHandler(streamHandler)
+	mux.Handle("/external/stitch", streamLimiter.Middleware(stitchHandler))
+	mux.Handle("/intranet/stitch", streamLimiter.Middleware(stitchHandler))
+	mux.Handle("/auto/stitch", streamLimiter.Middleware(stitchHandler))
+
+	// Audio-only extraction
+	mux.Handle("/external/audio", streamLimiter.Middleware(audioHandler))
+	mux.Handle("/intranet/audio", streamLimiter.Middleware(audioHandler))
+	mux.Handle("/auto/audio", streamLimiter.Middleware(audioHandler))
+
+	// Admin API (authenticated)
+	apiMux := http.NewServeMux()
+	apiMux.Handle("/api/v1/config/", configHandler)
+	apiMux.Handle("/api/v1/breakers", breakerHandler)
+	if lectureArchive != nil {
+		archiveHandler := handler.NewArchiveHandler(lectureArchive)
+		apiMux.Handle("/api/v1/archive", archiveHandler)
+		apiMux.Handle("/api/v1/archive/", archiveHandler)
+		recordingHandler := handler.NewRecordingHandler(lectureArchive)
+		apiMux.Handle("/api/v1/recordings", recordingHandler)
+		apiMux.Handle("/api/v1/recordings/", recordingHandler)
+	}
+	apiHandler := authenticator.Middleware(apiMux)
+
+	// Metrics and profiles need an admin key with read permission too
+	metricsHandler := authenticator.Middleware(metrics.Handler())
+
+	if cfg.PublicAdmin {
+		mux.Handle("/api/v1/", apiHandler)
+		mux.Handle("/metrics", metricsHandler)
+	} else {
+		log.Println("Admin routes disabled on the public listener")
+	}
 
-	// Config API
-	mux.HandleFunc("/api/v1/config/", configHandler.ServeHTTP)
+	// Optional admin listener with debug endpoints
+	if cfg.AdminAddr != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/health", healthHandler)
+		adminMux.Handle("/metrics", metricsHandler)
+		adminMux.Handle("/api/v1/", apiHandler)
+
+		pprofMux := http.NewServeMux()
+		pprofMux.HandleFunc("/debug/pprof/", pprof.Index)
+		pprofMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		pprofMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		pprofMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		pprofMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		adminMux.Handle("/debug/pprof/", authenticator.Middleware(pprofMux))
+
+		go func() {
+			log.Printf("Admin server listening on %s", cfg.AdminAddr)
+			if err := http.ListenAndServe(cfg.AdminAddr, corsMiddleware(adminMux)); err != nil {
+				log.Fatalf("Admin server failed: %v", err)
+			}
+		}()
+	}
 
 	// CORS middleware wrapper
 	corsHandler := corsMiddleware(mux)
 
 	// Start server
 	addr := ":" + cfg.Port
+	server := &http.Server{Addr: addr, Handler: corsHandler}
+
+	if cfg.TLSCertFile != "" {
+		tlsConfig, err := buildTLSConfig(cfg.TLSClientCAFile)
+		if err != nil {
+			log.Fatalf("Failed to configure TLS: %v", err)
+		}
+		server.TLSConfig = tlsConfig
+
+		log.Printf("Server listening on %s (TLS)", addr)
+		if err := server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			log.Fatalf("Server failed: %v", err)
+		}
+		return
+	}
+
 	log.Printf("Server listening on %s", addr)
-	if err := http.ListenAndServe(addr, corsHandler); err != nil {
+	if err := server.ListenAndServe(); err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
 
+// transportConfig applies a per-mode time-to-first-byte limit to the
+// shared transport settings
+func transportConfig(c proxy.TransportConfig, responseHeaderTimeout time.Duration) proxy.TransportConfig {
+	c.ResponseHeaderTimeout = responseHeaderTimeout
+	return c
+}
+
+// buildTLSConfig optionally requests client certificates signed by the
+// given CA. Certificates are verified if presented but not required, so
+// public stream endpoints keep working for ordinary clients.
+func buildTLSConfig(clientCAFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConfig, nil
+}
+
 // corsMiddleware adds CORS headers to all responses
-func corsMiddleware(next http.Handler) http.Handler {
+func corsMiddleware(mux *http.ServeMux) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
 		if r.Method == "OPTIONS" {
@@ -98,10 +297,28 @@ func corsMiddleware(next http.Handler) http.Handler {
 		// Log request
 		log.Printf("%s %s", r.Method, r.URL.Path)
 
-		next.ServeHTTP(w, r)
+		rec := auth.NewStatusRecorder(w)
+		mux.ServeHTTP(rec, r)
+		httpRequests.With(routeLabel(mux, r), strconv.Itoa(rec.Status)).Inc()
 	})
 }
 
+var httpRequests = metrics.NewCounterVec(
+	"proxy_http_requests_total",
+	"Requests served by route and status code",
+	"route", "code",
+)
+
+// routeLabel names the registered pattern serving r (e.g. "/external/ts/",
+// "/api/v1/"), or "other" for unknown paths, so arbitrary request paths
+// cannot grow the metric's label set
+func routeLabel(mux *http.ServeMux, r *http.Request) string {
+	if _, pattern := mux.Handler(r); pattern != "" {
+		return pattern
+	}
+	return "other"
+}
+
 func init() {
 	// Suppress unused import error for strings package
 	_ = strings.TrimSpace
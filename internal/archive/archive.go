@@ -0,0 +1,624 @@
+package archive
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/autoslides/video-proxy/internal/m3u8"
+	"github.com/autoslides/video-proxy/internal/metrics"
+)
+
+const (
+	manifestFile  = "job.json"
+	playlistFile  = "playlist.m3u8"
+	schedulesFile = "schedules.json"
+
+	filePerm    = 0o644
+	privatePerm = 0o600 // Job manifests and schedules hold login tokens
+
+	// Segment progress is saved this often rather than after every segment.
+	// A crash loses little: resumed archive jobs recount their segments on
+	// disk, and recordings refetch what is still in the live window.
+	persistEvery    = 50
+	persistInterval = 10 * time.Second
+)
+
+var segmentDownloads = metrics.NewCounterVec(
+	"proxy_archive_segments_total",
+	"Segments downloaded into the archive by result",
+	"result",
+)
+
+// Status is the state of an archive job
+type Status string
+
+const (
+	StatusScheduled Status = "scheduled" // recording waiting for its start time
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusCompleted Status = "completed"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+// Kind distinguishes mirrored lectures from recorded live classes
+type Kind string
+
+const (
+	KindArchive   Kind = "archive"
+	KindRecording Kind = "recording"
+)
+
+// Fetcher downloads lecture content from the upstream
+type Fetcher interface {
+	// Playlist fetches the media playlist at playlistURL, resolving a master
+	// playlist to one variant
+	Playlist(ctx context.Context, playlistURL, loginToken, mode string) (*Playlist, error)
+	// Segment downloads one segment, or only byteRange of it if not nil
+	Segment(ctx context.Context, segmentURL string, byteRange *m3u8.ByteRange, loginToken, mode string) ([]byte, error)
+}
+
+// Playlist is a fetched media playlist
+type Playlist struct {
+	URL            string    // Media playlist URL, after resolving a master playlist
+	Content        []byte    // Playlist as served by the upstream
+	Segments       []Segment // In playlist order
+	TargetDuration float64   // EXT-X-TARGETDURATION in seconds, 0 if absent
+	Ended          bool      // EXT-X-ENDLIST is present; the playlist will not grow
+}
+
+// Segment is a media segment of a playlist
+type Segment struct {
+	URL           string          `json:"url"`                  // Absolute segment URL
+	ByteRange     *m3u8.ByteRange `json:"byte_range,omitempty"` // Part of URL holding the segment
+	Duration      float64         `json:"duration"`
+	Discontinuity bool            `json:"discontinuity,omitempty"` // Segments before it were missed
+}
+
+// key identifies the segment among others packed into the same file
+func (s Segment) key() string {
+	if s.ByteRange == nil {
+		return s.URL
+	}
+	return s.URL + "#" + s.ByteRange.String()
+}
+
+// Job is the public view of an archive job or recording
+type Job struct {
+	ID            string     `json:"id"`
+	Kind          Kind       `json:"kind"`
+	URL           string     `json:"url"`
+	Mode          string     `json:"mode"`
+	Status        Status     `json:"status"`
+	ScheduleID    string     `json:"schedule_id,omitempty"`
+	Start         *time.Time `json:"start,omitempty"` // Recording window
+	End           *time.Time `json:"end,omitempty"`
+	MediaURL      string     `json:"media_url,omitempty"`
+	SegmentsTotal int        `json:"segments_total"`
+	SegmentsDone  int        `json:"segments_done"`
+	Bytes         int64      `json:"bytes"`
+	Error         string     `json:"error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// manifest is a job as persisted in its directory, with what is needed
+// to resume it after a restart
+type manifest struct {
+	Job
+	LoginToken string    `json:"login_token"`
+	Segments   []Segment `json:"segments,omitempty"` // Downloaded or recorded segments in order
+
+	savedAt time.Time // Last time the manifest was written
+	unsaved int       // Progress updates since then
+}
+
+// Manager runs archive jobs, mirroring playlists and their segments to
+// local storage, and serves completed archives to the handlers
+type Manager struct {
+	dir     string
+	fetcher Fetcher
+	jobSem  chan struct{} // Bounds concurrently running jobs
+	workers int           // Concurrent segment downloads per job
+
+	mu        sync.RWMutex
+	jobs      map[string]*manifest      // key: job ID
+	byKey     map[string]string         // key: jobKey of an archive job, value: job ID
+	playlists map[string]string         // key: requested or media playlist URL of a completed archive, value: job ID
+	segments  map[string]string         // key: segment URL and byte range of a completed archive, value: file path
+	stops     map[string]func()         // key: ID of a queued or running archive job, or a pending or running recording
+	schedules map[string]*scheduleEntry // key: schedule ID
+}
+
+// New creates an archive in dir and resumes the jobs left unfinished by a
+// previous run. An empty dir disables archiving and returns nil, which
+// all lookups treat as an empty archive.
+func New(dir string, fetcher Fetcher, jobs, workers int) (*Manager, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		dir:       dir,
+		fetcher:   fetcher,
+		jobSem:    make(chan struct{}, jobs),
+		workers:   workers,
+		jobs:      make(map[string]*manifest),
+		byKey:     make(map[string]string),
+		playlists: make(map[string]string),
+		segments:  make(map[string]string),
+		stops:     make(map[string]func()),
+		schedules: make(map[string]*scheduleEntry),
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	if err := m.loadSchedules(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// load reads the job manifests in the archive directory, indexing
+// completed archives and restarting unfinished jobs and recordings
+func (m *Manager) load() error {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return err
+	}
+
+	var resume, record []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(m.dir, entry.Name(), manifestFile))
+		if err != nil {
+			continue
+		}
+		var job manifest
+		if err := json.Unmarshal(data, &job); err != nil {
+			log.Printf("Skipping invalid archive job %s: %v", entry.Name(), err)
+			continue
+		}
+		if job.ID != entry.Name() {
+			log.Printf("Skipping archive job %s: manifest is for %s", entry.Name(), job.ID)
+			continue
+		}
+
+		m.jobs[job.ID] = &job
+		if job.Kind == KindRecording {
+			if job.Status == StatusScheduled || job.Status == StatusRunning {
+				record = append(record, job.ID)
+			}
+			continue
+		}
+
+		m.byKey[jobKey(job.URL, job.LoginToken)] = job.ID
+		switch job.Status {
+		case StatusCompleted:
+			m.index(&job)
+		case StatusQueued, StatusRunning:
+			job.Status = StatusQueued
+			resume = append(resume, job.ID)
+		}
+	}
+
+	if len(resume) > 0 {
+		log.Printf("Resuming %d archive jobs", len(resume))
+	}
+	m.mu.Lock()
+	for _, id := range resume {
+		m.start(id)
+	}
+	m.mu.Unlock()
+	if len(record) > 0 {
+		log.Printf("Resuming %d recordings", len(record))
+	}
+	for _, id := range record {
+		m.startRecording(id)
+	}
+	return nil
+}
+
+// Submit queues a job archiving the playlist at url. A job already
+// queued, running or completed for the same URL and login token is
+// returned instead of starting a new one; a failed or cancelled job is
+// resumed. created reports whether a job was queued.
+func (m *Manager) Submit(url, loginToken, mode string) (job Job, created bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if id, ok := m.byKey[jobKey(url, loginToken)]; ok {
+		existing := m.jobs[id]
+		if existing.Status != StatusFailed && existing.Status != StatusCancelled {
+			return existing.Job, false, nil
+		}
+		existing.Mode = mode
+		existing.Status = StatusQueued
+		existing.Error = ""
+		existing.UpdatedAt = time.Now()
+		if err := m.persist(existing); err != nil {
+			return Job{}, false, err
+		}
+		m.start(id)
+		return existing.Job, true, nil
+	}
+
+	id, err := newID()
+	if err != nil {
+		return Job{}, false, err
+	}
+	now := time.Now()
+	j := &manifest{
+		Job: Job{
+			ID:        id,
+			Kind:      KindArchive,
+			URL:       url,
+			Mode:      mode,
+			Status:    StatusQueued,
+			CreatedAt: now,
+			UpdatedAt: now,
+		},
+		LoginToken: loginToken,
+	}
+	if err := os.MkdirAll(m.jobDir(id), 0o755); err != nil {
+		return Job{}, false, err
+	}
+	if err := m.persist(j); err != nil {
+		return Job{}, false, err
+	}
+
+	m.jobs[id] = j
+	m.byKey[jobKey(url, loginToken)] = id
+	m.start(id)
+	return j.Job, true, nil
+}
+
+// Get returns the job of a kind with the given ID
+func (m *Manager) Get(kind Kind, id string) (Job, bool) {
+	if m == nil {
+		return Job{}, false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	job, ok := m.jobs[id]
+	if !ok || job.Kind != kind {
+		return Job{}, false
+	}
+	return job.Job, true
+}
+
+// List returns the jobs of a kind, oldest first
+func (m *Manager) List(kind Kind) []Job {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.RLock()
+	jobs := make([]Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		if job.Kind == kind {
+			jobs = append(jobs, job.Job)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+	return jobs
+}
+
+// Playlist returns the archived media playlist for a playlist URL and the
+// URL its segments are relative to
+func (m *Manager) Playlist(url string) (mediaURL string, content []byte, ok bool) {
+	if m == nil {
+		return "", nil, false
+	}
+
+	m.mu.RLock()
+	id, ok := m.playlists[url]
+	if ok {
+		mediaURL = m.jobs[id].MediaURL
+	}
+	m.mu.RUnlock()
+	if !ok {
+		return "", nil, false
+	}
+
+	content, err := os.ReadFile(filepath.Join(m.jobDir(id), playlistFile))
+	if err != nil {
+		log.Printf("Failed to read archived playlist %s: %v", id, err)
+		return "", nil, false
+	}
+	return mediaURL, content, true
+}
+
+// Segment returns the file holding an archived segment. byteRange selects
+// one of several segments packed into the file at url.
+func (m *Manager) Segment(url string, byteRange *m3u8.ByteRange) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	path, ok := m.segments[Segment{URL: url, ByteRange: byteRange}.key()]
+	return path, ok
+}
+
+// Cancel stops a queued or running archive job. The segments downloaded
+// so far are kept, so submitting the job again resumes it.
+func (m *Manager) Cancel(id string) bool {
+	if m == nil {
+		return false
+	}
+
+	m.mu.RLock()
+	cancel, ok := m.stops[id]
+	m.mu.RUnlock()
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// start runs a job in the background until it completes, fails or is
+// cancelled. Callers must hold mu.
+func (m *Manager) start(id string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.stops[id] = cancel
+
+	go func() {
+		defer cancel()
+		m.run(ctx, id)
+	}()
+}
+
+// run waits for a job slot and downloads the job
+func (m *Manager) run(ctx context.Context, id string) {
+	var err error
+	select {
+	case m.jobSem <- struct{}{}:
+		m.update(id, func(job *manifest) { job.Status = StatusRunning })
+		err = m.download(ctx, id)
+		<-m.jobSem
+	case <-ctx.Done():
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.stops, id)
+	job := m.jobs[id]
+	job.UpdatedAt = time.Now()
+	if ctx.Err() != nil {
+		log.Printf("Archive job %s cancelled", id)
+		job.Status = StatusCancelled
+		job.Error = ""
+	} else if err != nil {
+		log.Printf("Archive job %s failed: %v", id, err)
+		job.Status = StatusFailed
+		job.Error = err.Error()
+	} else {
+		log.Printf("Archive job %s completed: %d segments, %d bytes", id, job.SegmentsTotal, job.Bytes)
+		job.Status = StatusCompleted
+		m.index(job)
+	}
+	if err := m.persist(job); err != nil {
+		log.Printf("Failed to save archive job %s: %v", id, err)
+	}
+}
+
+// download mirrors the playlist of a job, unless an earlier run already
+// did, then every segment not yet on disk
+func (m *Manager) download(ctx context.Context, id string) error {
+	m.mu.RLock()
+	job := *m.jobs[id]
+	m.mu.RUnlock()
+
+	dir := m.jobDir(id)
+	if _, err := os.Stat(filepath.Join(dir, playlistFile)); err != nil || len(job.Segments) == 0 {
+		playlist, err := m.fetcher.Playlist(ctx, job.URL, job.LoginToken, job.Mode)
+		if err != nil {
+			return fmt.Errorf("playlist: %w", err)
+		}
+		if len(playlist.Segments) == 0 {
+			return errors.New("playlist has no segments")
+		}
+		if err := writeFile(filepath.Join(dir, playlistFile), playlist.Content, filePerm); err != nil {
+			return err
+		}
+		job.MediaURL = playlist.URL
+		job.Segments = playlist.Segments
+	}
+
+	// Segments already on disk count as done
+	var pending []int
+	var bytes int64
+	for i := range job.Segments {
+		if info, err := os.Stat(segmentPath(dir, i)); err == nil {
+			bytes += info.Size()
+			continue
+		}
+		pending = append(pending, i)
+	}
+	m.update(id, func(j *manifest) {
+		j.MediaURL = job.MediaURL
+		j.Segments = job.Segments
+		j.SegmentsTotal = len(job.Segments)
+		j.SegmentsDone = len(job.Segments) - len(pending)
+		j.Bytes = bytes
+	})
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	queue := make(chan int)
+	for w := 0; w < m.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				n, err := m.downloadSegment(ctx, &job, i)
+				if err != nil {
+					if ctx.Err() == nil {
+						segmentDownloads.With("failed").Inc()
+					}
+					errOnce.Do(func() {
+						firstErr = fmt.Errorf("segment %d of %d: %w", i+1, len(job.Segments), err)
+						cancel()
+					})
+					continue
+				}
+				segmentDownloads.With("fetched").Inc()
+				m.progress(id, func(j *manifest) {
+					j.SegmentsDone++
+					j.Bytes += n
+				})
+			}
+		}()
+	}
+
+	for _, i := range pending {
+		select {
+		case queue <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return firstErr
+}
+
+// downloadSegment stores one segment, writing to a temporary file first
+// so a partial download is never mistaken for a finished one
+func (m *Manager) downloadSegment(ctx context.Context, job *manifest, i int) (int64, error) {
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	data, err := m.fetcher.Segment(ctx, job.Segments[i].URL, job.Segments[i].ByteRange, job.LoginToken, job.Mode)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeFile(segmentPath(m.jobDir(job.ID), i), data, filePerm); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+// update applies fn to a job and saves its manifest
+func (m *Manager) update(id string, fn func(*manifest)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job := m.jobs[id]
+	fn(job)
+	job.UpdatedAt = time.Now()
+	if err := m.persist(job); err != nil {
+		log.Printf("Failed to save archive job %s: %v", id, err)
+	}
+}
+
+// progress applies fn to a job like update, but saves its manifest only
+// every persistEvery updates or persistInterval
+func (m *Manager) progress(id string, fn func(*manifest)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job := m.jobs[id]
+	fn(job)
+	job.UpdatedAt = time.Now()
+	job.unsaved++
+	if job.unsaved < persistEvery && time.Since(job.savedAt) < persistInterval {
+		return
+	}
+	if err := m.persist(job); err != nil {
+		log.Printf("Failed to save archive job %s: %v", id, err)
+	}
+}
+
+// index makes a completed job servable. Callers must hold mu.
+func (m *Manager) index(job *manifest) {
+	m.playlists[job.URL] = job.ID
+	m.playlists[job.MediaURL] = job.ID
+	dir := m.jobDir(job.ID)
+	for i, seg := range job.Segments {
+		m.segments[seg.key()] = segmentPath(dir, i)
+	}
+}
+
+// persist writes a job's manifest. Callers must hold mu.
+func (m *Manager) persist(job *manifest) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	job.savedAt, job.unsaved = time.Now(), 0
+	return writeFile(filepath.Join(m.jobDir(job.ID), manifestFile), data, privatePerm)
+}
+
+// jobKey identifies the archive jobs of one viewer, so a job submitted
+// by one login token is never joined or resumed with another
+func jobKey(url, loginToken string) string {
+	return loginToken + "|" + url
+}
+
+func (m *Manager) jobDir(id string) string {
+	return filepath.Join(m.dir, id)
+}
+
+func segmentPath(dir string, i int) string {
+	return filepath.Join(dir, segmentName(i))
+}
+
+func segmentName(i int) string {
+	return fmt.Sprintf("%05d.ts", i)
+}
+
+// writeFile replaces path atomically with a file of mode perm
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".part"
+	// A leftover from a crash would keep its old mode
+	os.Remove(tmp)
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,459 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Live playlists are polled this often until their target duration is known
+const defaultPollInterval = 5 * time.Second
+
+// Schedule is the public view of a recurring recording
+type Schedule struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Mode      string    `json:"mode"`
+	Cron      string    `json:"cron"`
+	Duration  string    `json:"duration"`
+	Next      time.Time `json:"next"` // Start of the next recording
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// scheduleEntry is a schedule as persisted, with its parsed timing
+type scheduleEntry struct {
+	Schedule
+	LoginToken string `json:"login_token"`
+
+	cron     *cronSpec
+	duration time.Duration
+	stop     context.CancelFunc
+}
+
+// Record queues a recording of the live playlist at url between start
+// and end. A start in the past records from now on.
+func (m *Manager) Record(url, loginToken, mode string, start, end time.Time) (Job, error) {
+	return m.newRecording(url, loginToken, mode, start, end, "")
+}
+
+func (m *Manager) newRecording(url, loginToken, mode string, start, end time.Time, scheduleID string) (Job, error) {
+	id, err := newID()
+	if err != nil {
+		return Job{}, err
+	}
+	now := time.Now()
+	j := &manifest{
+		Job: Job{
+			ID:         id,
+			Kind:       KindRecording,
+			URL:        url,
+			Mode:       mode,
+			Status:     StatusScheduled,
+			ScheduleID: scheduleID,
+			Start:      &start,
+			End:        &end,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		},
+		LoginToken: loginToken,
+	}
+	if err := os.MkdirAll(m.jobDir(id), 0o755); err != nil {
+		return Job{}, err
+	}
+
+	m.mu.Lock()
+	if err := m.persist(j); err != nil {
+		m.mu.Unlock()
+		return Job{}, err
+	}
+	m.jobs[id] = j
+	job := j.Job
+	m.mu.Unlock()
+
+	log.Printf("Scheduled recording %s of %s from %s to %s", id, url, start.Format(time.RFC3339), end.Format(time.RFC3339))
+	m.startRecording(id)
+	return job, nil
+}
+
+// Stop ends a scheduled or running recording early, keeping the
+// segments recorded so far
+func (m *Manager) Stop(id string) bool {
+	if m == nil {
+		return false
+	}
+
+	m.mu.RLock()
+	stop, ok := m.stops[id]
+	m.mu.RUnlock()
+	if ok {
+		stop()
+	}
+	return ok
+}
+
+// startRecording runs a recording in the background until its end time
+func (m *Manager) startRecording(id string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.mu.Lock()
+	m.stops[id] = cancel
+	m.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		m.record(ctx, id)
+	}()
+}
+
+// record waits for the start of a recording, captures the live playlist
+// until the end time, the playlist ends or the recording is stopped, and
+// then writes the VOD playlist
+func (m *Manager) record(ctx context.Context, id string) {
+	m.mu.RLock()
+	job := *m.jobs[id]
+	m.mu.RUnlock()
+
+	if wait := time.Until(*job.Start); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+	}
+
+	if ctx.Err() == nil && time.Now().Before(*job.End) {
+		log.Printf("Recording %s started", id)
+		m.update(id, func(j *manifest) { j.Status = StatusRunning })
+
+		captureCtx, cancel := context.WithDeadline(ctx, *job.End)
+		m.capture(captureCtx, &job)
+		cancel()
+	}
+
+	m.finishRecording(id)
+}
+
+// capture polls the live playlist and stores every new segment
+func (m *Manager) capture(ctx context.Context, job *manifest) {
+	seen := make(map[string]bool, len(job.Segments))
+	for _, seg := range job.Segments {
+		seen[seg.key()] = true
+	}
+
+	interval := defaultPollInterval
+	for {
+		playlist, err := m.fetcher.Playlist(ctx, job.URL, job.LoginToken, job.Mode)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// The stream may not be up yet; keep polling until the end time
+			log.Printf("Recording %s: failed to fetch playlist: %v", job.ID, err)
+			m.update(job.ID, func(j *manifest) { j.Error = err.Error() })
+		} else {
+			if playlist.TargetDuration > 0 {
+				interval = time.Duration(playlist.TargetDuration * float64(time.Second) / 2)
+				if interval < time.Second {
+					interval = time.Second
+				}
+			}
+			m.captureSegments(ctx, job, playlist, seen)
+			if playlist.Ended {
+				log.Printf("Recording %s: live playlist ended", job.ID)
+				return
+			}
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// captureSegments downloads the segments of a poll not seen before, in
+// order. A failed segment stops the pass so it is retried on the next poll.
+func (m *Manager) captureSegments(ctx context.Context, job *manifest, playlist *Playlist, seen map[string]bool) {
+	// If nothing in the window was seen before, segments scrolled out
+	// between polls (or while the proxy was down)
+	missed := len(job.Segments) > 0
+	for _, seg := range playlist.Segments {
+		if seen[seg.key()] {
+			missed = false
+			break
+		}
+	}
+
+	dir := m.jobDir(job.ID)
+	for _, seg := range playlist.Segments {
+		if seen[seg.key()] {
+			continue
+		}
+
+		data, err := m.fetcher.Segment(ctx, seg.URL, seg.ByteRange, job.LoginToken, job.Mode)
+		if err == nil {
+			err = writeFile(segmentPath(dir, len(job.Segments)), data, filePerm)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			segmentDownloads.With("failed").Inc()
+			log.Printf("Recording %s: failed to fetch segment: %v", job.ID, err)
+			m.update(job.ID, func(j *manifest) { j.Error = err.Error() })
+			return
+		}
+		segmentDownloads.With("fetched").Inc()
+
+		seg.Discontinuity = missed
+		missed = false
+		seen[seg.key()] = true
+		job.Segments = append(job.Segments, seg)
+
+		segments := job.Segments
+		m.progress(job.ID, func(j *manifest) {
+			j.Segments = segments
+			j.SegmentsTotal = len(segments)
+			j.SegmentsDone = len(segments)
+			j.Bytes += int64(len(data))
+			j.Error = ""
+		})
+	}
+}
+
+// finishRecording writes the VOD playlist of a recording
+func (m *Manager) finishRecording(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.stops, id)
+	job := m.jobs[id]
+	job.UpdatedAt = time.Now()
+
+	if len(job.Segments) == 0 {
+		job.Status = StatusFailed
+		if job.Error == "" {
+			job.Error = "no segments recorded"
+		}
+		log.Printf("Recording %s failed: %s", id, job.Error)
+	} else if err := writeFile(filepath.Join(m.jobDir(id), playlistFile), vodPlaylist(job.Segments), filePerm); err != nil {
+		job.Status = StatusFailed
+		job.Error = err.Error()
+		log.Printf("Recording %s failed: %v", id, err)
+	} else {
+		job.Status = StatusCompleted
+		job.Error = ""
+		log.Printf("Recording %s completed: %d segments, %d bytes", id, len(job.Segments), job.Bytes)
+	}
+
+	if err := m.persist(job); err != nil {
+		log.Printf("Failed to save recording %s: %v", id, err)
+	}
+}
+
+// vodPlaylist lists recorded segments by their file names
+func vodPlaylist(segments []Segment) []byte {
+	target := 1.0
+	for _, seg := range segments {
+		target = math.Max(target, seg.Duration)
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n")
+	for i, seg := range segments {
+		if seg.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", seg.Duration, segmentName(i))
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return []byte(b.String())
+}
+
+// AddSchedule records the live playlist at url for duration at every
+// time matching the cron expression spec
+func (m *Manager) AddSchedule(url, loginToken, mode, spec string, duration time.Duration) (Schedule, error) {
+	cron, err := parseCron(spec)
+	if err != nil {
+		return Schedule{}, err
+	}
+	id, err := newID()
+	if err != nil {
+		return Schedule{}, err
+	}
+
+	entry := &scheduleEntry{
+		Schedule: Schedule{
+			ID:        id,
+			URL:       url,
+			Mode:      mode,
+			Cron:      spec,
+			Duration:  duration.String(),
+			CreatedAt: time.Now(),
+		},
+		LoginToken: loginToken,
+		cron:       cron,
+		duration:   duration,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.schedules[id] = entry
+	if err := m.persistSchedules(); err != nil {
+		delete(m.schedules, id)
+		return Schedule{}, err
+	}
+	m.startSchedule(entry)
+	return entry.view(), nil
+}
+
+// Schedules returns all schedules, oldest first
+func (m *Manager) Schedules() []Schedule {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.RLock()
+	schedules := make([]Schedule, 0, len(m.schedules))
+	for _, entry := range m.schedules {
+		schedules = append(schedules, entry.view())
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].CreatedAt.Before(schedules[j].CreatedAt)
+	})
+	return schedules
+}
+
+// RemoveSchedule deletes a schedule. Recordings it already started are
+// not affected.
+func (m *Manager) RemoveSchedule(id string) (bool, error) {
+	if m == nil {
+		return false, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.schedules[id]
+	if !ok {
+		return false, nil
+	}
+	entry.stop()
+	delete(m.schedules, id)
+	return true, m.persistSchedules()
+}
+
+func (e *scheduleEntry) view() Schedule {
+	s := e.Schedule
+	s.Next = e.cron.next(time.Now())
+	return s
+}
+
+// loadSchedules reads the persisted schedules and starts them
+func (m *Manager) loadSchedules() error {
+	data, err := os.ReadFile(filepath.Join(m.dir, schedulesFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []*scheduleEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("%s: %w", schedulesFile, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, entry := range entries {
+		if entry.cron, err = parseCron(entry.Cron); err != nil {
+			log.Printf("Skipping recording schedule %s: %v", entry.ID, err)
+			continue
+		}
+		if entry.duration, err = time.ParseDuration(entry.Duration); err != nil {
+			log.Printf("Skipping recording schedule %s: %v", entry.ID, err)
+			continue
+		}
+		m.schedules[entry.ID] = entry
+		m.startSchedule(entry)
+	}
+	return nil
+}
+
+// persistSchedules writes all schedules. Callers must hold mu.
+func (m *Manager) persistSchedules() error {
+	entries := make([]*scheduleEntry, 0, len(m.schedules))
+	for _, entry := range m.schedules {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(m.dir, schedulesFile), data, privatePerm)
+}
+
+// startSchedule runs a schedule in the background. Callers must hold mu.
+func (m *Manager) startSchedule(entry *scheduleEntry) {
+	ctx, cancel := context.WithCancel(context.Background())
+	entry.stop = cancel
+	go m.runSchedule(ctx, entry)
+}
+
+// runSchedule starts a recording at every occurrence of a schedule. An
+// occurrence already under way, for example after a restart, is recorded
+// from now on unless a recording for it exists.
+func (m *Manager) runSchedule(ctx context.Context, entry *scheduleEntry) {
+	start := entry.cron.next(time.Now().Add(-entry.duration))
+	for ; !start.IsZero(); start = entry.cron.next(start) {
+		end := start.Add(entry.duration)
+		if !end.After(time.Now()) || m.hasRecording(entry.ID, start) {
+			continue
+		}
+
+		if wait := time.Until(start); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if _, err := m.newRecording(entry.URL, entry.LoginToken, entry.Mode, start, end, entry.ID); err != nil {
+			log.Printf("Failed to start recording for schedule %s: %v", entry.ID, err)
+		}
+	}
+}
+
+// hasRecording reports whether a schedule already started a recording at start
+func (m *Manager) hasRecording(scheduleID string, start time.Time) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, job := range m.jobs {
+		if job.ScheduleID == scheduleID && job.Start != nil && job.Start.Equal(start) {
+			return true
+		}
+	}
+	return false
+}
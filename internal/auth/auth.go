@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+type Permission string
+
+const (
+	// PermRead allows GET/HEAD requests to the admin API
+	PermRead Permission = "read"
+	// PermWrite allows reloading and modifying configuration (implies read)
+	PermWrite Permission = "write"
+)
+
+// Allows reports whether p grants the required permission
+func (p Permission) Allows(required Permission) bool {
+	switch p {
+	case PermWrite:
+		return required == PermRead || required == PermWrite
+	case PermRead:
+		return required == PermRead
+	default:
+		return false
+	}
+}
+
+// Identity is the authenticated caller of an admin request
+type Identity struct {
+	Name       string     `json:"name"`
+	Method     string     `json:"method"` // "token" or "mtls"
+	Permission Permission `json:"permission"`
+}
+
+type apiKey struct {
+	Name       string     `json:"name"`
+	Token      string     `json:"token"`
+	Permission Permission `json:"permission"`
+}
+
+type clientCert struct {
+	Name       string     `json:"name"`
+	CommonName string     `json:"common_name"`
+	Permission Permission `json:"permission"`
+}
+
+type keysFile struct {
+	Keys    []apiKey     `json:"keys"`
+	Clients []clientCert `json:"clients"`
+}
+
+type Authenticator struct {
+	mu       sync.RWMutex
+	keys     []apiKey
+	clients  map[string]clientCert // key: certificate common name
+	keysFile string
+}
+
+type contextKey struct{}
+
+// New creates an authenticator backed by a keys file. With an empty path
+// no credentials are accepted and every admin request is rejected.
+func New(keysFile string) (*Authenticator, error) {
+	a := &Authenticator{
+		clients:  make(map[string]clientCert),
+		keysFile: keysFile,
+	}
+
+	if keysFile == "" {
+		log.Println("No admin keys file configured, admin API is disabled")
+		return a, nil
+	}
+
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Reload reads keys and client certificate rules from the keys file
+func (a *Authenticator) Reload() error {
+	if a.keysFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.keysFile)
+	if err != nil {
+		return err
+	}
+
+	var parsed keysFile
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+
+	clients := make(map[string]clientCert, len(parsed.Clients))
+	for _, k := range parsed.Keys {
+		if k.Name == "" || k.Token == "" {
+			return fmt.Errorf("admin key entries need a name and token")
+		}
+		if k.Permission != PermRead && k.Permission != PermWrite {
+			return fmt.Errorf("admin key %s: unknown permission %q", k.Name, k.Permission)
+		}
+	}
+	for _, c := range parsed.Clients {
+		if c.CommonName == "" {
+			return fmt.Errorf("client certificate entries need a common_name")
+		}
+		if c.Permission != PermRead && c.Permission != PermWrite {
+			return fmt.Errorf("client certificate %s: unknown permission %q", c.CommonName, c.Permission)
+		}
+		if c.Name == "" {
+			c.Name = c.CommonName
+		}
+		clients[c.CommonName] = c
+	}
+
+	a.mu.Lock()
+	a.keys = parsed.Keys
+	a.clients = clients
+	a.mu.Unlock()
+
+	log.Printf("Loaded %d admin keys and %d client certificates from %s", len(parsed.Keys), len(clients), a.keysFile)
+	return nil
+}
+
+// Middleware authenticates admin requests. GET and HEAD need read
+// permission, every other method needs write permission. Writes are
+// audit logged with the caller's identity and the resulting status.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		required := PermWrite
+		if r.Method == "GET" || r.Method == "HEAD" {
+			required = PermRead
+		}
+
+		id, ok := a.authenticate(r)
+		if !ok {
+			log.Printf("audit: rejected unauthenticated %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		if !id.Permission.Allows(required) {
+			log.Printf("audit: denied %s %s to %s (%s, %s)", r.Method, r.URL.Path, id.Name, id.Method, id.Permission)
+			writeError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), contextKey{}, id))
+
+		if required == PermRead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := NewStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+		log.Printf("audit: %s %s by %s (%s) from %s -> %d",
+			r.Method, r.URL.RequestURI(), id.Name, id.Method, r.RemoteAddr, rec.Status)
+	})
+}
+
+// IdentityFrom returns the identity attached by Middleware
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(Identity)
+	return id, ok
+}
+
+func (a *Authenticator) authenticate(r *http.Request) (Identity, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if header := r.Header.Get("Authorization"); header != "" {
+		token, found := strings.CutPrefix(header, "Bearer ")
+		if !found {
+			return Identity{}, false
+		}
+		for _, k := range a.keys {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(k.Token)) == 1 {
+				return Identity{Name: k.Name, Method: "token", Permission: k.Permission}, true
+			}
+		}
+		return Identity{}, false
+	}
+
+	// Only certificates verified against the client CA are considered
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if c, ok := a.clients[cn]; ok {
+			return Identity{Name: c.Name, Method: "mtls", Permission: c.Permission}, true
+		}
+	}
+
+	return Identity{}, false
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "error",
+		"error":  message,
+	})
+}
+
+// StatusRecorder captures the response status for audit logging and
+// request metrics
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+// NewStatusRecorder wraps w, reporting 200 until a status is written
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (s *StatusRecorder) WriteHeader(status int) {
+	s.Status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *StatusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
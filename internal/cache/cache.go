@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/autoslides/video-proxy/internal/metrics"
+)
+
+var lookups = metrics.NewCounterVec(
+	"proxy_segment_cache_lookups_total",
+	"Segment cache lookups by result",
+	"result",
+)
+
+// Entry is a cached segment body
+type Entry struct {
+	Data        []byte
+	ContentType string
+	storedAt    time.Time
+}
+
+type item struct {
+	key   string
+	entry Entry
+}
+
+// Cache is an in-memory LRU cache bounded by total bytes, with entries
+// expiring after a TTL
+type Cache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	ttl      time.Duration
+	size     int64
+	order    *list.List // front = most recently used
+	items    map[string]*list.Element
+}
+
+// New creates a cache. A maxBytes of zero or less disables caching and
+// returns nil, which all methods treat as an empty cache.
+func New(maxBytes int64, ttl time.Duration) *Cache {
+	if maxBytes <= 0 {
+		return nil
+	}
+
+	c := &Cache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+	metrics.NewGaugeFunc("proxy_segment_cache_bytes", "Bytes held in the segment cache", func() float64 {
+		return float64(c.Size())
+	})
+	return c
+}
+
+// Get returns the entry for key if present and not expired
+func (c *Cache) Get(key string) (Entry, bool) {
+	if c == nil {
+		return Entry{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		lookups.With("miss").Inc()
+		return Entry{}, false
+	}
+
+	it := el.Value.(*item)
+	if c.ttl > 0 && time.Since(it.entry.storedAt) > c.ttl {
+		c.remove(el)
+		lookups.With("miss").Inc()
+		return Entry{}, false
+	}
+
+	c.order.MoveToFront(el)
+	lookups.With("hit").Inc()
+	return it.entry, true
+}
+
+// Contains reports whether key is cached without counting a lookup
+func (c *Cache) Contains(key string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	return ok && (c.ttl <= 0 || time.Since(el.Value.(*item).entry.storedAt) <= c.ttl)
+}
+
+// Set stores an entry, evicting least recently used entries to stay
+// within the size limit. Entries larger than the whole cache are dropped.
+func (c *Cache) Set(key string, entry Entry) {
+	if c == nil || int64(len(entry.Data)) > c.maxBytes {
+		return
+	}
+
+	entry.storedAt = time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+
+	c.items[key] = c.order.PushFront(&item{key: key, entry: entry})
+	c.size += int64(len(entry.Data))
+
+	for c.size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// Size returns the number of bytes currently cached
+func (c *Cache) Size() int64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *Cache) remove(el *list.Element) {
+	it := el.Value.(*item)
+	c.order.Remove(el)
+	delete(c.items, it.key)
+	c.size -= int64(len(it.entry.Data))
+}
@@ -2,7 +2,12 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/autoslides/video-proxy/internal/proxy"
+	"github.com/autoslides/video-proxy/internal/ratelimit"
 )
 
 type Config struct {
@@ -11,9 +16,57 @@ type Config struct {
 	VideoHost        string
 	MagicKey         string
 	LogLevel         string
-	RequestTimeout   time.Duration
-	IntranetTimeout  time.Duration
+	RequestTimeout   time.Duration // External time to first byte
+	IntranetTimeout  time.Duration // Intranet time to first byte
+	RequestIdle      time.Duration // External per-read idle timeout
+	IntranetIdle     time.Duration // Intranet per-read idle timeout
 	MappingsFile     string
+	AdminKeysFile    string
+	TLSCertFile      string
+	TLSKeyFile       string
+	TLSClientCAFile  string
+	AdminAddr        string
+	PublicAdmin      bool // Defaults to true unless AdminAddr is set
+	TrustForwarded   bool
+	RateLimitKey     string
+	StreamRateLimit  RateLimit
+	SegmentRateLimit RateLimit
+	ConnBandwidth    ratelimit.Bandwidth
+	TokenBandwidth   ratelimit.Bandwidth
+	GlobalBandwidth  ratelimit.Bandwidth
+	Transport        proxy.TransportConfig // Shared upstream transport settings, minus the per-mode time to first byte
+	ExternalRetry    proxy.RetryPolicy
+	IntranetRetry    proxy.RetryPolicy
+	Breaker          proxy.BreakerConfig
+	AutoPrefer       string        // Network path /auto/ routes try first: "intranet" or "external"
+	HedgeDelay       time.Duration // Race a second intranet IP after this delay (0 disables)
+	SegmentCache     int64         // Segment cache size in bytes (0 disables)
+	SegmentCacheTTL  time.Duration
+	Prefetch         PrefetchConfig
+	Archive          ArchiveConfig
+	LiveAccumulate   bool          // Serve live playlists with every segment seen so far
+	LiveTTL          time.Duration // Forget a live playlist after this long without requests
+}
+
+// RateLimit is a token bucket setting in requests per second. A zero
+// rate disables limiting.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// PrefetchConfig controls reading ahead into the segment cache
+type PrefetchConfig struct {
+	Segments    int           // Segments fetched past the requested one (0 disables)
+	Concurrency int           // Concurrent prefetches across all viewers
+	IdleTimeout time.Duration // Stop prefetching for a viewer after this long without requests
+}
+
+// ArchiveConfig controls mirroring lectures to local storage
+type ArchiveConfig struct {
+	Dir                string // Archive directory (empty disables archiving)
+	Concurrency        int    // Jobs downloading at once
+	SegmentConcurrency int    // Segments downloading at once per job
 }
 
 func Load() *Config {
@@ -25,7 +78,55 @@ func Load() *Config {
 		LogLevel:         getEnv("LOG_LEVEL", "info"),
 		RequestTimeout:   parseDuration(getEnv("REQUEST_TIMEOUT", "30s"), 30*time.Second),
 		IntranetTimeout:  parseDuration(getEnv("INTRANET_TIMEOUT", "8s"), 8*time.Second),
+		RequestIdle:      parseDuration(getEnv("REQUEST_IDLE_TIMEOUT", "15s"), 15*time.Second),
+		IntranetIdle:     parseDuration(getEnv("INTRANET_IDLE_TIMEOUT", "8s"), 8*time.Second),
 		MappingsFile:     getEnv("MAPPINGS_FILE", "./mappings.json"),
+		AdminKeysFile:    getEnv("ADMIN_KEYS_FILE", ""),
+		TLSCertFile:      getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:       getEnv("TLS_KEY_FILE", ""),
+		TLSClientCAFile:  getEnv("TLS_CLIENT_CA_FILE", ""),
+		AdminAddr:        getEnv("ADMIN_ADDR", ""),
+		PublicAdmin:      parseBool(getEnv("PUBLIC_ADMIN_ROUTES", ""), getEnv("ADMIN_ADDR", "") == ""),
+		TrustForwarded:   parseBool(getEnv("TRUST_FORWARDED_FOR", "false"), false),
+		RateLimitKey:     getEnv("RATE_LIMIT_KEY", "ip"),
+		StreamRateLimit:  parseRateLimit("RATE_LIMIT_STREAM"),
+		SegmentRateLimit: parseRateLimit("RATE_LIMIT_SEGMENT"),
+		ConnBandwidth:    parseBandwidth("BANDWIDTH_PER_CONN"),
+		TokenBandwidth:   parseBandwidth("BANDWIDTH_PER_TOKEN"),
+		GlobalBandwidth:  parseBandwidth("BANDWIDTH_GLOBAL"),
+		Transport: proxy.TransportConfig{
+			MaxIdleConns:        parseInt(getEnv("UPSTREAM_MAX_IDLE_CONNS", "256"), 256),
+			MaxIdleConnsPerHost: parseInt(getEnv("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", "32"), 32),
+			MaxConnsPerHost:     parseInt(getEnv("UPSTREAM_MAX_CONNS_PER_HOST", "0"), 0),
+			IdleConnTimeout:     parseDuration(getEnv("UPSTREAM_IDLE_CONN_TIMEOUT", "90s"), 90*time.Second),
+			DialTimeout:         parseDuration(getEnv("UPSTREAM_DIAL_TIMEOUT", "5s"), 5*time.Second),
+			KeepAlive:           parseDuration(getEnv("UPSTREAM_KEEPALIVE", "30s"), 30*time.Second),
+			TLSHandshakeTimeout: parseDuration(getEnv("UPSTREAM_TLS_HANDSHAKE_TIMEOUT", "5s"), 5*time.Second),
+			HTTP2:               parseBool(getEnv("UPSTREAM_HTTP2", "true"), true),
+		},
+		ExternalRetry: parseRetryPolicy("EXTERNAL_"),
+		IntranetRetry: parseRetryPolicy("INTRANET_"),
+		AutoPrefer:    getEnv("AUTO_PREFER", "intranet"),
+		HedgeDelay:    parseDuration(getEnv("HEDGE_DELAY", "0"), 0),
+		Breaker: proxy.BreakerConfig{
+			FailureThreshold: parseInt(getEnv("BREAKER_FAILURE_THRESHOLD", "5"), 5),
+			OpenTimeout:      parseDuration(getEnv("BREAKER_OPEN_TIMEOUT", "30s"), 30*time.Second),
+			HalfOpenProbes:   parseInt(getEnv("BREAKER_HALF_OPEN_PROBES", "1"), 1),
+		},
+		SegmentCache:    parseByteSize(getEnv("SEGMENT_CACHE_SIZE", "0"), 0),
+		SegmentCacheTTL: parseDuration(getEnv("SEGMENT_CACHE_TTL", "5m"), 5*time.Minute),
+		Prefetch: PrefetchConfig{
+			Segments:    parseInt(getEnv("PREFETCH_SEGMENTS", "0"), 0),
+			Concurrency: parseInt(getEnv("PREFETCH_CONCURRENCY", "4"), 4),
+			IdleTimeout: parseDuration(getEnv("PREFETCH_IDLE_TIMEOUT", "30s"), 30*time.Second),
+		},
+		Archive: ArchiveConfig{
+			Dir:                getEnv("ARCHIVE_DIR", ""),
+			Concurrency:        parseInt(getEnv("ARCHIVE_CONCURRENCY", "2"), 2),
+			SegmentConcurrency: parseInt(getEnv("ARCHIVE_SEGMENT_CONCURRENCY", "4"), 4),
+		},
+		LiveAccumulate: parseBool(getEnv("LIVE_ACCUMULATE", "false"), false),
+		LiveTTL:        parseDuration(getEnv("LIVE_ACCUMULATE_TTL", "3h"), 3*time.Hour),
 	}
 }
 
@@ -43,3 +144,103 @@ func parseDuration(s string, defaultValue time.Duration) time.Duration {
 	}
 	return d
 }
+
+func parseBool(s string, defaultValue bool) bool {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return defaultValue
+	}
+	return b
+}
+
+func parseInt(s string, defaultValue int) int {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return defaultValue
+	}
+	return i
+}
+
+func parseFloat(s string, defaultValue float64) float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return defaultValue
+	}
+	return f
+}
+
+// parseRateLimit reads <prefix> (requests per second) and <prefix>_BURST.
+// The burst defaults to one second worth of requests.
+func parseRateLimit(prefix string) RateLimit {
+	rate := parseFloat(getEnv(prefix, "0"), 0)
+	defaultBurst := int(rate)
+	if defaultBurst < 1 {
+		defaultBurst = 1
+	}
+	return RateLimit{
+		Rate:  rate,
+		Burst: parseInt(getEnv(prefix+"_BURST", ""), defaultBurst),
+	}
+}
+
+// parseByteSize parses sizes like "1048576", "512KB" or "2M" (1024-based)
+func parseByteSize(s string, defaultValue int64) int64 {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "B")
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return defaultValue
+	}
+	return int64(n * float64(multiplier))
+}
+
+// parseBandwidth reads <prefix> (bytes per second) and <prefix>_BURST.
+// The burst defaults to one second worth of bytes.
+func parseBandwidth(prefix string) ratelimit.Bandwidth {
+	rate := parseByteSize(getEnv(prefix, "0"), 0)
+	return ratelimit.Bandwidth{
+		Rate:  rate,
+		Burst: parseByteSize(getEnv(prefix+"_BURST", ""), rate),
+	}
+}
+
+// parseRetryPolicy reads RETRY_* settings, overridden per mode by
+// <modePrefix>RETRY_* (e.g. INTRANET_RETRY_MAX_ATTEMPTS)
+func parseRetryPolicy(modePrefix string) proxy.RetryPolicy {
+	get := func(name, defaultValue string) string {
+		return getEnv(modePrefix+"RETRY_"+name, getEnv("RETRY_"+name, defaultValue))
+	}
+
+	return proxy.RetryPolicy{
+		MaxAttempts:     parseInt(get("MAX_ATTEMPTS", "4"), 4),
+		BaseDelay:       parseDuration(get("BASE_DELAY", "500ms"), 500*time.Millisecond),
+		MaxDelay:        parseDuration(get("MAX_DELAY", "5s"), 5*time.Second),
+		Jitter:          parseFloat(get("JITTER", "0.5"), 0.5),
+		RetryableStatus: parseIntList(get("STATUS", "403,429,502,503,504")),
+		HonorRetryAfter: parseBool(get("HONOR_RETRY_AFTER", "true"), true),
+	}
+}
+
+func parseIntList(s string) []int {
+	var result []int
+	for _, part := range strings.Split(s, ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+			result = append(result, n)
+		}
+	}
+	return result
+}
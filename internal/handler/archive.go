@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/autoslides/video-proxy/internal/archive"
+	"github.com/autoslides/video-proxy/internal/crypto"
+	"github.com/autoslides/video-proxy/internal/m3u8"
+	"github.com/autoslides/video-proxy/internal/proxy"
+	"github.com/autoslides/video-proxy/internal/token"
+)
+
+// ArchiveFetcher downloads lectures for the archive through the same
+// signed and retried upstream requests as the proxy handlers
+type ArchiveFetcher struct {
+	upstream
+}
+
+func NewArchiveFetcher(
+	crypto *crypto.Crypto,
+	tokenCache *token.TokenCache,
+	client *proxy.Client,
+	videoHost string,
+) *ArchiveFetcher {
+	return &ArchiveFetcher{
+		upstream: upstream{
+			crypto:     crypto,
+			tokenCache: tokenCache,
+			client:     client,
+			videoHost:  videoHost,
+		},
+	}
+}
+
+// Playlist implements archive.Fetcher
+func (f *ArchiveFetcher) Playlist(ctx context.Context, playlistURL, loginToken, mode string) (*archive.Playlist, error) {
+	mediaURL, media, _, err := f.fetchMediaPlaylist(ctx, playlistURL, loginToken, networkMode(mode))
+	if err != nil {
+		return nil, err
+	}
+
+	playlist := &archive.Playlist{
+		URL:            mediaURL,
+		Content:        media.Encode(),
+		TargetDuration: float64(media.TargetDuration),
+		Ended:          media.EndList,
+	}
+	for _, seg := range media.Segments {
+		playlist.Segments = append(playlist.Segments, archive.Segment{
+			URL:       resolveURL(mediaURL, seg.URI),
+			ByteRange: seg.ByteRange,
+			Duration:  seg.Duration,
+		})
+	}
+	return playlist, nil
+}
+
+// Segment implements archive.Fetcher
+func (f *ArchiveFetcher) Segment(ctx context.Context, segmentURL string, byteRange *m3u8.ByteRange, loginToken, mode string) ([]byte, error) {
+	data, _, err := f.fetchSegment(ctx, segmentURL, byteRange, loginToken, networkMode(mode))
+	return data, err
+}
+
+type ArchiveHandler struct {
+	archive *archive.Manager
+}
+
+func NewArchiveHandler(archive *archive.Manager) *ArchiveHandler {
+	return &ArchiveHandler{archive: archive}
+}
+
+// archiveRequest is the body of POST /api/v1/archive
+type archiveRequest struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+	Mode  string `json:"mode"` // "external" (default), "intranet" or "auto"
+}
+
+// ServeHTTP handles POST /api/v1/archive to queue a job, GET
+// /api/v1/archive to list jobs, GET /api/v1/archive/{id} for the
+// progress of one job and DELETE /api/v1/archive/{id} to cancel it
+func (h *ArchiveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/archive")
+	id = strings.Trim(id, "/")
+
+	switch {
+	case id == "" && r.Method == "POST":
+		h.submit(w, r)
+	case id == "" && r.Method == "GET":
+		json.NewEncoder(w).Encode(h.archive.List(archive.KindArchive))
+	case id != "" && r.Method == "GET":
+		job, ok := h.archive.Get(archive.KindArchive, id)
+		if !ok {
+			http.Error(w, "Archive job not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(job)
+	case id != "" && r.Method == "DELETE":
+		if _, ok := h.archive.Get(archive.KindArchive, id); !ok {
+			http.Error(w, "Archive job not found", http.StatusNotFound)
+			return
+		}
+		if !h.archive.Cancel(id) {
+			http.Error(w, "Archive job already finished", http.StatusConflict)
+			return
+		}
+		log.Printf("Cancelling archive job %s", id)
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *ArchiveHandler) submit(w http.ResponseWriter, r *http.Request) {
+	var req archiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if req.URL == "" || req.Token == "" {
+		http.Error(w, "Missing required fields: url and token", http.StatusBadRequest)
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = string(modeExternal)
+	}
+	if !validMode(req.Mode) {
+		http.Error(w, "Invalid mode", http.StatusBadRequest)
+		return
+	}
+
+	// Fix URL escaping
+	req.URL = strings.ReplaceAll(req.URL, "\\/", "/")
+
+	job, created, err := h.archive.Submit(req.URL, req.Token, req.Mode)
+	if err != nil {
+		log.Printf("Failed to queue archive job: %v", err)
+		http.Error(w, "Failed to queue archive job", http.StatusInternalServerError)
+		return
+	}
+
+	if created {
+		log.Printf("Queued archive job %s for %s", job.ID, job.URL)
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(job)
+}
+
+// validMode reports whether mode names a network mode
+func validMode(mode string) bool {
+	switch networkMode(mode) {
+	case modeExternal, modeIntranet, modeAuto:
+		return true
+	}
+	return false
+}
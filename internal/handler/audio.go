@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/autoslides/video-proxy/internal/crypto"
+	"github.com/autoslides/video-proxy/internal/proxy"
+	"github.com/autoslides/video-proxy/internal/ratelimit"
+	"github.com/autoslides/video-proxy/internal/remux"
+	"github.com/autoslides/video-proxy/internal/token"
+)
+
+type AudioHandler struct {
+	upstream
+	throttle *ratelimit.Throttle // Optional bandwidth caps for the audio body
+}
+
+func NewAudioHandler(
+	crypto *crypto.Crypto,
+	tokenCache *token.TokenCache,
+	client *proxy.Client,
+	videoHost string,
+) *AudioHandler {
+	return &AudioHandler{
+		upstream: upstream{
+			crypto:     crypto,
+			tokenCache: tokenCache,
+			client:     client,
+			videoHost:  videoHost,
+		},
+	}
+}
+
+// SetThrottle sets the bandwidth throttle applied to audio downloads
+func (h *AudioHandler) SetThrottle(t *ratelimit.Throttle) {
+	h.throttle = t
+}
+
+// ServeHTTP handles /external/audio, /intranet/audio and /auto/audio. The
+// AAC track is extracted from the segments and sent as ADTS, or as M4A
+// with format=m4a, optionally limited to the start and end positions.
+func (h *AudioHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Determine mode from path
+	mode := modeFromPath(r.URL.Path)
+
+	// Parse query parameters
+	originalURL := r.URL.Query().Get("url")
+	loginToken := r.URL.Query().Get("token")
+
+	if originalURL == "" || loginToken == "" {
+		http.Error(w, "Missing required parameters: url and token", http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "aac"
+	}
+	if format != "aac" && format != "m4a" {
+		http.Error(w, "Unsupported format", http.StatusBadRequest)
+		return
+	}
+
+	start, end, err := parseTimeRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Fix URL escaping
+	originalURL = strings.ReplaceAll(originalURL, "\\/", "/")
+
+	playlistURL, segments, usedIntranet, err := h.mediaPlaylist(r.Context(), originalURL, loginToken, mode)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		log.Printf("Failed to fetch M3U8 for audio: %v", err)
+		writePlaylistError(w, err)
+		return
+	}
+
+	segments, offset := selectRange(segments, start, end)
+	if len(segments) == 0 {
+		http.Error(w, "Requested range is outside the recording", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	opts := remux.Options{Format: remux.FormatADTS, Start: start - offset}
+	if end > 0 {
+		opts.End = end - offset
+	}
+	contentType := "audio/aac"
+	if format == "m4a" {
+		opts.Format = remux.FormatMP4
+		opts.AudioOnly = true
+		if r.URL.Query().Get("layout") == "progressive" {
+			opts.Layout = remux.Progressive
+		}
+		contentType = "audio/mp4"
+	}
+
+	filename := r.URL.Query().Get("filename")
+	if filename == "" {
+		filename = downloadName(originalURL)
+	}
+	setAttachmentHeaders(w, contentType, filename+"."+format, usedIntranet)
+
+	// Segments come over the path that served the playlist
+	tracker := &responseTracker{ResponseWriter: w}
+	body := h.throttle.Wrap(r.Context(), tracker, loginToken)
+	err = h.writeRemuxed(r.Context(), body, playlistURL, segments, loginToken, usedIntranet, opts)
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("Audio extraction failed: %v", err)
+		writeDownloadError(w, tracker, err)
+	}
+}
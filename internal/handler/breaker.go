@@ -0,0 +1,28 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/autoslides/video-proxy/internal/proxy"
+)
+
+type BreakerHandler struct {
+	client *proxy.Client
+}
+
+func NewBreakerHandler(client *proxy.Client) *BreakerHandler {
+	return &BreakerHandler{client: client}
+}
+
+// ServeHTTP lists the circuit breaker state of every upstream seen so far
+func (h *BreakerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(h.client.BreakerStatus())
+}
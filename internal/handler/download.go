@@ -0,0 +1,246 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/autoslides/video-proxy/internal/crypto"
+	"github.com/autoslides/video-proxy/internal/m3u8"
+	"github.com/autoslides/video-proxy/internal/proxy"
+	"github.com/autoslides/video-proxy/internal/ratelimit"
+	"github.com/autoslides/video-proxy/internal/remux"
+	"github.com/autoslides/video-proxy/internal/token"
+)
+
+// errRemux marks segments that could not be converted to MP4
+var errRemux = errors.New("remux failed")
+
+type DownloadHandler struct {
+	upstream
+	throttle *ratelimit.Throttle // Optional bandwidth caps for the file body
+}
+
+func NewDownloadHandler(
+	crypto *crypto.Crypto,
+	tokenCache *token.TokenCache,
+	client *proxy.Client,
+	videoHost string,
+) *DownloadHandler {
+	return &DownloadHandler{
+		upstream: upstream{
+			crypto:     crypto,
+			tokenCache: tokenCache,
+			client:     client,
+			videoHost:  videoHost,
+		},
+	}
+}
+
+// SetThrottle sets the bandwidth throttle applied to downloads
+func (h *DownloadHandler) SetThrottle(t *ratelimit.Throttle) {
+	h.throttle = t
+}
+
+// ServeHTTP handles /external/download, /intranet/download and
+// /auto/download. All segments of the playlist are streamed back to back
+// as a single MPEG-TS file, or remuxed to MP4 with format=mp4. Optional
+// start and end parameters export only that part of the lecture.
+func (h *DownloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Determine mode from path
+	mode := modeFromPath(r.URL.Path)
+
+	// Parse query parameters
+	originalURL := r.URL.Query().Get("url")
+	loginToken := r.URL.Query().Get("token")
+
+	if originalURL == "" || loginToken == "" {
+		http.Error(w, "Missing required parameters: url and token", http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ts"
+	}
+	if format != "ts" && format != "mp4" {
+		http.Error(w, "Unsupported format", http.StatusBadRequest)
+		return
+	}
+
+	start, end, err := parseTimeRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Fix URL escaping
+	originalURL = strings.ReplaceAll(originalURL, "\\/", "/")
+
+	playlistURL, segments, usedIntranet, err := h.mediaPlaylist(r.Context(), originalURL, loginToken, mode)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		log.Printf("Failed to fetch M3U8 for download: %v", err)
+		writePlaylistError(w, err)
+		return
+	}
+
+	segments, offset := selectRange(segments, start, end)
+	if len(segments) == 0 {
+		http.Error(w, "Requested range is outside the recording", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	filename := r.URL.Query().Get("filename")
+	if filename == "" {
+		filename = downloadName(originalURL)
+	}
+
+	contentType := "video/mp2t"
+	if format == "mp4" {
+		contentType = "video/mp4"
+	}
+	setAttachmentHeaders(w, contentType, filename+"."+format, usedIntranet)
+
+	// Segments come over the path that served the playlist
+	tracker := &responseTracker{ResponseWriter: w}
+	body := h.throttle.Wrap(r.Context(), tracker, loginToken)
+	if format == "mp4" {
+		// MP4 clips are cut at the exact window; TS clips keep whole segments
+		opts := remux.Options{Layout: remux.Fragmented, Start: start - offset}
+		if end > 0 {
+			opts.End = end - offset
+		}
+		if r.URL.Query().Get("layout") == "progressive" {
+			opts.Layout = remux.Progressive
+		}
+		err = h.writeRemuxed(r.Context(), body, playlistURL, segments, loginToken, usedIntranet, opts)
+	} else {
+		err = h.writeTS(r.Context(), body, playlistURL, segments, loginToken, usedIntranet)
+	}
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("Download failed: %v", err)
+		writeDownloadError(w, tracker, err)
+	}
+}
+
+// writeTS streams the segments back to back
+func (h *DownloadHandler) writeTS(
+	ctx context.Context,
+	w http.ResponseWriter,
+	playlistURL string,
+	segments []*m3u8.Segment,
+	loginToken string,
+	isIntranet bool,
+) error {
+	body := &bodyWriter{ResponseWriter: w}
+	for i, seg := range segments {
+		tsURL := resolveURL(playlistURL, seg.URI)
+		if err := h.proxySegmentPath(ctx, body, tsURL, seg.ByteRange, loginToken, isIntranet); err != nil {
+			return fmt.Errorf("segment %d of %d: %w", i+1, len(segments), err)
+		}
+	}
+	return nil
+}
+
+// writeRemuxed converts the segments with the remuxer as they are downloaded
+func (u *upstream) writeRemuxed(
+	ctx context.Context,
+	w http.ResponseWriter,
+	playlistURL string,
+	segments []*m3u8.Segment,
+	loginToken string,
+	isIntranet bool,
+	opts remux.Options,
+) error {
+	remuxer := remux.New(w, opts)
+	for i, seg := range segments {
+		tsURL := resolveURL(playlistURL, seg.URI)
+		data, _, err := u.fetchSegmentPath(ctx, tsURL, seg.ByteRange, loginToken, isIntranet)
+		if err != nil {
+			remuxer.Abort()
+			return fmt.Errorf("segment %d of %d: %w", i+1, len(segments), err)
+		}
+		if err := remuxer.WriteSegment(data); err != nil {
+			remuxer.Abort()
+			return fmt.Errorf("%w: segment %d of %d: %w", errRemux, i+1, len(segments), err)
+		}
+	}
+	if err := remuxer.Close(); err != nil {
+		return fmt.Errorf("%w: %w", errRemux, err)
+	}
+	return nil
+}
+
+// setAttachmentHeaders prepares a file download response
+func setAttachmentHeaders(w http.ResponseWriter, contentType, filename string, usedIntranet bool) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": filename,
+	}))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Proxy-Path, Content-Disposition")
+	w.Header().Set("X-Proxy-Path", pathName(usedIntranet))
+}
+
+// writePlaylistError reports a failure to resolve the media playlist
+func writePlaylistError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errVideoToken):
+		http.Error(w, "Failed to get video token", http.StatusInternalServerError)
+	case errors.Is(err, errMasterPlaylist):
+		http.Error(w, "Playlist has no variants", http.StatusBadGateway)
+	case errors.Is(err, errInvalidPlaylist):
+		http.Error(w, "Invalid M3U8", http.StatusBadGateway)
+	default:
+		http.Error(w, "Failed to fetch M3U8", upstreamErrorStatus(err))
+	}
+}
+
+// writeDownloadError reports a failed download if nothing was sent yet,
+// and otherwise aborts the connection so the client sees a truncated
+// transfer instead of a complete file
+func writeDownloadError(w http.ResponseWriter, tracker *responseTracker, err error) {
+	if tracker.started {
+		panic(http.ErrAbortHandler)
+	}
+
+	w.Header().Del("Content-Disposition")
+	if errors.Is(err, errRemux) {
+		http.Error(w, "Failed to convert stream", http.StatusUnprocessableEntity)
+		return
+	}
+	http.Error(w, "Failed to fetch TS segment", upstreamErrorStatus(err))
+}
+
+// downloadName derives a file name from the playlist URL
+func downloadName(playlistURL string) string {
+	name := "video"
+	if parsed, err := url.Parse(playlistURL); err == nil {
+		if base := path.Base(parsed.Path); base != "." && base != "/" {
+			name = strings.TrimSuffix(base, path.Ext(base))
+		}
+	}
+	return name
+}
+
+// bodyWriter passes segment bodies through while dropping the per-segment
+// upstream headers and status, which were already replaced by the
+// download's own response headers
+type bodyWriter struct {
+	http.ResponseWriter
+}
+
+func (b *bodyWriter) Header() http.Header {
+	return make(http.Header)
+}
+
+func (b *bodyWriter) WriteHeader(int) {}
@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/autoslides/video-proxy/internal/m3u8"
+)
+
+// InfoHandler describes a playlist as JSON so frontends need not parse
+// M3U8 themselves
+type InfoHandler struct {
+	stream *StreamHandler // Fetches and archives like /stream
+}
+
+func NewInfoHandler(stream *StreamHandler) *InfoHandler {
+	return &InfoHandler{stream: stream}
+}
+
+// playlistInfo is the response of /info. For a master playlist the
+// media fields describe its highest bandwidth variant.
+type playlistInfo struct {
+	URL            string        `json:"url"`             // Media playlist described
+	Type           string        `json:"type"`            // "vod", "event" or "live"
+	Live           bool          `json:"live"`            // More segments may follow
+	Duration       float64       `json:"duration"`        // Seconds, from EXTINF
+	Segments       int           `json:"segments"`        // Segment count
+	TargetDuration int           `json:"target_duration"` // Seconds
+	Encryption     string        `json:"encryption"`      // "NONE", "AES-128" or "SAMPLE-AES"
+	Variants       []variantInfo `json:"variants,omitempty"`
+	Path           string        `json:"path"` // "intranet", "external" or "archive"
+}
+
+type variantInfo struct {
+	URL        string  `json:"url"`
+	Bandwidth  int64   `json:"bandwidth"`
+	Resolution string  `json:"resolution,omitempty"`
+	Codecs     string  `json:"codecs,omitempty"`
+	FrameRate  float64 `json:"frame_rate,omitempty"`
+}
+
+// ServeHTTP handles /external/info, /intranet/info and /auto/info
+func (h *InfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Determine mode from path
+	mode := modeFromPath(r.URL.Path)
+
+	// Parse query parameters
+	originalURL := r.URL.Query().Get("url")
+	loginToken := r.URL.Query().Get("token")
+
+	if originalURL == "" || loginToken == "" {
+		http.Error(w, "Missing required parameters: url and token", http.StatusBadRequest)
+		return
+	}
+
+	// Fix URL escaping
+	originalURL = strings.ReplaceAll(originalURL, "\\/", "/")
+
+	info, err := h.info(r, originalURL, loginToken, mode)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		log.Printf("Failed to fetch M3U8 for info: %v", err)
+		writePlaylistError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Proxy-Path")
+	w.Header().Set("X-Proxy-Path", info.Path)
+	json.NewEncoder(w).Encode(info)
+}
+
+// info fetches the playlist the way /stream does and, for a master
+// playlist, its highest bandwidth variant
+func (h *InfoHandler) info(r *http.Request, originalURL, loginToken string, mode networkMode) (*playlistInfo, error) {
+	if mediaURL, content, ok := h.stream.archive.Playlist(originalURL); ok {
+		if err := h.stream.authorize(r.Context(), loginToken); err != nil {
+			return nil, err
+		}
+		playlist, err := m3u8.Parse(content)
+		if err != nil {
+			return nil, fmt.Errorf("%w: archived: %w", errInvalidPlaylist, err)
+		}
+		return describePlaylist(mediaURL, playlist, nil, "archive"), nil
+	}
+
+	content, usedIntranet, err := h.stream.fetchM3U8(r.Context(), originalURL, loginToken, mode)
+	if err != nil {
+		return nil, err
+	}
+	playlist, err := m3u8.Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidPlaylist, err)
+	}
+
+	mediaURL := originalURL
+	var variants []variantInfo
+	if playlist.Master {
+		for _, v := range playlist.Variants {
+			if v.IFrame {
+				continue
+			}
+			variants = append(variants, variantInfo{
+				URL:        resolveURL(originalURL, v.URI),
+				Bandwidth:  v.Bandwidth,
+				Resolution: v.Resolution,
+				Codecs:     v.Codecs,
+				FrameRate:  v.FrameRate,
+			})
+		}
+		variant, ok := bestVariant(playlist)
+		if !ok {
+			return nil, errMasterPlaylist
+		}
+		mediaURL = resolveURL(originalURL, variant.URI)
+
+		// Variants come over the path that served the master playlist
+		content, err = h.stream.fetchM3U8Path(r.Context(), mediaURL, loginToken, usedIntranet)
+		if err != nil {
+			return nil, err
+		}
+		if playlist, err = m3u8.Parse(content); err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidPlaylist, err)
+		}
+		if playlist.Master {
+			return nil, fmt.Errorf("%w: nested master playlist", errMasterPlaylist)
+		}
+	}
+
+	// Live playlists are described as /stream serves them
+	playlist = h.stream.live.accumulate(mediaURL, playlist)
+	return describePlaylist(mediaURL, playlist, variants, pathName(usedIntranet)), nil
+}
+
+// describePlaylist summarizes a media playlist
+func describePlaylist(mediaURL string, playlist *m3u8.Playlist, variants []variantInfo, proxyPath string) *playlistInfo {
+	info := &playlistInfo{
+		URL:            mediaURL,
+		Duration:       playlist.Duration(),
+		Segments:       len(playlist.Segments),
+		TargetDuration: playlist.TargetDuration,
+		Encryption:     "NONE",
+		Variants:       variants,
+		Path:           proxyPath,
+	}
+
+	switch {
+	case playlist.EndList || playlist.PlaylistType == "VOD":
+		info.Type = "vod"
+	case playlist.PlaylistType == "EVENT":
+		info.Type, info.Live = "event", true
+	default:
+		info.Type, info.Live = "live", true
+	}
+
+	for _, seg := range playlist.Segments {
+		if seg.Key != nil && seg.Key.Method != "NONE" {
+			info.Encryption = seg.Key.Method
+			break
+		}
+	}
+	return info
+}
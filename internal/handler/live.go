@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/autoslides/video-proxy/internal/m3u8"
+	"github.com/autoslides/video-proxy/internal/metrics"
+)
+
+// liveSegment is a segment with its media sequence number
+type liveSegment struct {
+	*m3u8.Segment
+	seq int64
+}
+
+// liveStream is everything seen of one live playlist
+type liveStream struct {
+	header                *m3u8.Playlist // Latest fetch, for the playlist-level tags
+	targetDuration        int            // Highest seen
+	discontinuitySequence int64          // Of the first fetch, where the kept segments start
+	segments              []liveSegment
+	uris                  map[string]bool
+	lastSeq               int64
+	ended                 bool
+	lastSeen              time.Time
+}
+
+// LiveAccumulator remembers every segment seen in a live playlist, so
+// viewers get the whole class so far instead of the upstream's sliding
+// window
+type LiveAccumulator struct {
+	ttl time.Duration // Forget streams nobody requested for this long
+
+	mu      sync.Mutex
+	streams map[string]*liveStream // key: playlist URL
+}
+
+// NewLiveAccumulator creates an accumulator that forgets a live playlist
+// once it has not been requested for ttl
+func NewLiveAccumulator(ttl time.Duration) *LiveAccumulator {
+	if ttl <= 0 {
+		ttl = 3 * time.Hour
+	}
+
+	a := &LiveAccumulator{
+		ttl:     ttl,
+		streams: make(map[string]*liveStream),
+	}
+	metrics.NewGaugeFunc("proxy_live_playlists", "Live playlists being accumulated", func() float64 {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return float64(len(a.streams))
+	})
+	go a.cleanup()
+	return a
+}
+
+// accumulate merges a fetched playlist into what was seen before and
+// returns an EVENT playlist with every segment so far, or a VOD playlist
+// once the stream has ended. Master playlists and playlists that were
+// complete when first seen are returned unchanged.
+func (a *LiveAccumulator) accumulate(playlistURL string, playlist *m3u8.Playlist) *m3u8.Playlist {
+	if a == nil || playlist.Master || len(playlist.Segments) == 0 {
+		return playlist
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stream, ok := a.streams[playlistURL]
+	if !ok {
+		if playlist.EndList || playlist.PlaylistType == "VOD" {
+			return playlist
+		}
+		stream = &liveStream{
+			uris:                  make(map[string]bool),
+			lastSeq:               -1,
+			discontinuitySequence: playlist.DiscontinuitySequence,
+		}
+		a.streams[playlistURL] = stream
+	}
+
+	stream.merge(playlist)
+	stream.lastSeen = time.Now()
+	return stream.render()
+}
+
+// merge appends the segments of a fetch that are newer than the last one
+// seen, by media sequence number
+func (s *liveStream) merge(p *m3u8.Playlist) {
+	s.header = p
+	s.targetDuration = max(s.targetDuration, p.TargetDuration)
+	if p.EndList {
+		s.ended = true
+	}
+
+	// A window entirely before the last segment seen is either a stale
+	// response or a stream that restarted its numbering. Only unknown
+	// URIs mean a restart.
+	restarted := false
+	if last := p.MediaSequence + int64(len(p.Segments)) - 1; s.lastSeq >= 0 && last < s.lastSeq {
+		for _, seg := range p.Segments {
+			if s.uris[segmentKey(seg.URI, seg.ByteRange)] {
+				return
+			}
+		}
+		s.lastSeq = p.MediaSequence - 1
+		restarted = true
+	}
+
+	for i, seg := range p.Segments {
+		seq := p.MediaSequence + int64(i)
+		if seq <= s.lastSeq {
+			continue
+		}
+		if restarted || (s.lastSeq >= 0 && seq > s.lastSeq+1) {
+			seg.Discontinuity = true
+			restarted = false
+		}
+		s.segments = append(s.segments, liveSegment{Segment: seg, seq: seq})
+		s.uris[segmentKey(seg.URI, seg.ByteRange)] = true
+		s.lastSeq = seq
+	}
+}
+
+// render builds the accumulated playlist from copies of the latest header
+// and of the segments, so rewriting it leaves the stream untouched
+func (s *liveStream) render() *m3u8.Playlist {
+	p := *s.header
+	p.Tags = slices.Clone(s.header.Tags)
+	p.Trailer = slices.Clone(s.header.Trailer)
+	p.TargetDuration = s.targetDuration
+	p.DiscontinuitySequence = s.discontinuitySequence
+	p.PlaylistType = "EVENT"
+	p.EndList = s.ended
+	if s.ended {
+		p.PlaylistType = "VOD"
+	}
+	p.Segments = make([]*m3u8.Segment, 0, len(s.segments))
+	if len(s.segments) > 0 {
+		p.MediaSequence = s.segments[0].seq
+	}
+	for _, seg := range s.segments {
+		p.Segments = append(p.Segments, seg.Clone())
+	}
+	return &p
+}
+
+// cleanup forgets live playlists nobody has requested for the TTL
+func (a *LiveAccumulator) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		a.mu.Lock()
+		for key, stream := range a.streams {
+			if now.Sub(stream.lastSeen) > a.ttl {
+				delete(a.streams, key)
+			}
+		}
+		a.mu.Unlock()
+	}
+}
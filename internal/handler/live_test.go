@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/autoslides/video-proxy/internal/m3u8"
+)
+
+func TestAccumulateKeepsHeader(t *testing.T) {
+	window := func(lines ...string) *m3u8.Playlist {
+		p, err := m3u8.Parse([]byte(strings.Join(lines, "\n") + "\n"))
+		if err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+		return p
+	}
+	a := &LiveAccumulator{streams: make(map[string]*liveStream)}
+
+	a.accumulate("live.m3u8", window(
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		"#EXT-X-TARGETDURATION:4",
+		"#EXT-X-MEDIA-SEQUENCE:10",
+		"#EXT-X-DISCONTINUITY-SEQUENCE:2",
+		"#EXT-X-START:TIME-OFFSET=0",
+		"#EXTINF:4,",
+		"a.ts",
+		"#EXT-X-DISCONTINUITY",
+		"#EXTINF:4,",
+		"b.ts",
+	))
+	// The discontinuity before b.ts has left the upstream window
+	got := a.accumulate("live.m3u8", window(
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		"#EXT-X-TARGETDURATION:4",
+		"#EXT-X-MEDIA-SEQUENCE:11",
+		"#EXT-X-DISCONTINUITY-SEQUENCE:3",
+		"#EXT-X-START:TIME-OFFSET=0",
+		"#EXTINF:4,",
+		"b.ts",
+		"#EXTINF:4,",
+		"c.ts",
+	))
+
+	want := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		"#EXT-X-TARGETDURATION:4",
+		"#EXT-X-MEDIA-SEQUENCE:10",
+		"#EXT-X-DISCONTINUITY-SEQUENCE:2",
+		"#EXT-X-START:TIME-OFFSET=0",
+		"#EXT-X-PLAYLIST-TYPE:EVENT",
+		"#EXTINF:4,",
+		"a.ts",
+		"#EXT-X-DISCONTINUITY",
+		"#EXTINF:4,",
+		"b.ts",
+		"#EXTINF:4,",
+		"c.ts",
+	}, "\n") + "\n"
+	if s := got.String(); s != want {
+		t.Errorf("got\n%s\nwant\n%s", s, want)
+	}
+}
@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/autoslides/video-proxy/internal/m3u8"
+)
+
+// bestVariant returns the variant of a master playlist with the highest
+// bandwidth, ignoring I-frame variants
+func bestVariant(p *m3u8.Playlist) (*m3u8.Variant, bool) {
+	var best *m3u8.Variant
+	for _, v := range p.Variants {
+		if !v.IFrame && (best == nil || v.Bandwidth > best.Bandwidth) {
+			best = v
+		}
+	}
+	return best, best != nil
+}
+
+// segmentWindow returns the indexes of the first and last segments
+// overlapping [start, end) by their EXTINF durations, or -1 for both when
+// none does. A zero end selects through the last segment.
+func segmentWindow(segments []*m3u8.Segment, start, end time.Duration) (first, last int) {
+	first, last = -1, -1
+	var position time.Duration
+	for i, seg := range segments {
+		segStart := position
+		position += time.Duration(seg.Duration * float64(time.Second))
+		if position <= start {
+			continue
+		}
+		if end > 0 && segStart >= end {
+			break
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+	}
+	return first, last
+}
+
+// selectRange returns the segments overlapping [start, end) by their
+// EXTINF durations, and where the first of them starts. A zero end
+// selects through the last segment.
+func selectRange(segments []*m3u8.Segment, start, end time.Duration) ([]*m3u8.Segment, time.Duration) {
+	first, last := segmentWindow(segments, start, end)
+	if first < 0 {
+		return nil, 0
+	}
+	var offset time.Duration
+	for _, seg := range segments[:first] {
+		offset += time.Duration(seg.Duration * float64(time.Second))
+	}
+	return segments[first : last+1], offset
+}
+
+// clipPlaylist trims a media playlist to the segments overlapping
+// [start, end) by their EXTINF durations, measured from its first
+// segment. Media and discontinuity sequence numbers are advanced past the
+// dropped segments, the key and map in effect at the first kept segment
+// are carried over, and a playlist cut short by end is closed with
+// EXT-X-ENDLIST. Master playlists are left unchanged. It fails when no
+// segment overlaps the window.
+func clipPlaylist(p *m3u8.Playlist, start, end time.Duration) bool {
+	if p.Master {
+		return true
+	}
+	first, last := segmentWindow(p.Segments, start, end)
+	if first < 0 {
+		return false
+	}
+
+	var (
+		key     *m3u8.Key
+		initMap *m3u8.Map
+	)
+	for _, seg := range p.Segments[:first] {
+		if seg.Discontinuity {
+			p.DiscontinuitySequence++
+		}
+		if seg.Key != nil {
+			key = seg.Key
+		}
+		if seg.Map != nil {
+			initMap = seg.Map
+		}
+	}
+	kept := p.Segments[first : last+1]
+	if kept[0].Key == nil {
+		kept[0].Key = key
+	}
+	if kept[0].Map == nil {
+		kept[0].Map = initMap
+	}
+
+	if last < len(p.Segments)-1 {
+		p.Trailer = nil
+		p.EndList = true
+	}
+	p.MediaSequence += int64(first)
+	p.Segments = kept
+	return true
+}
+
+// parseOffset parses a playback position given as seconds ("90.5"),
+// clock time ("1:30", "1:02:03") or a Go duration ("1m30s")
+func parseOffset(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("negative offset %q", s)
+		}
+		return offsetSeconds(seconds, s)
+	}
+	if strings.Contains(s, ":") {
+		parts := strings.Split(s, ":")
+		if len(parts) > 3 {
+			return 0, fmt.Errorf("invalid offset %q", s)
+		}
+		var total float64
+		for _, part := range parts {
+			value, err := strconv.ParseFloat(part, 64)
+			if err != nil || value < 0 {
+				return 0, fmt.Errorf("invalid offset %q", s)
+			}
+			total = total*60 + value
+		}
+		return offsetSeconds(total, s)
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid offset %q", s)
+	}
+	return d, nil
+}
+
+// offsetSeconds converts parsed seconds, which ParseFloat lets be NaN,
+// infinite or too large for a Duration
+func offsetSeconds(seconds float64, s string) (time.Duration, error) {
+	if math.IsNaN(seconds) || math.IsInf(seconds, 0) || seconds >= math.MaxInt64/float64(time.Second) {
+		return 0, fmt.Errorf("invalid offset %q", s)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// parseTimeRange reads the optional start and end query parameters
+func parseTimeRange(query url.Values) (start, end time.Duration, err error) {
+	if start, err = parseOffset(query.Get("start")); err != nil {
+		return 0, 0, err
+	}
+	if end, err = parseOffset(query.Get("end")); err != nil {
+		return 0, 0, err
+	}
+	if end > 0 && end <= start {
+		return 0, 0, errInvalidRange
+	}
+	return start, end, nil
+}
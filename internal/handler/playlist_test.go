@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseOffset(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "90.5", want: 90500 * time.Millisecond},
+		{in: "1:30", want: 90 * time.Second},
+		{in: "1:02:03", want: time.Hour + 2*time.Minute + 3*time.Second},
+		{in: "1m30s", want: 90 * time.Second},
+		{in: "-1", wantErr: true},
+		{in: "-1s", wantErr: true},
+		{in: "1:2:3:4", wantErr: true},
+		{in: "1:-2", wantErr: true},
+		{in: "abc", wantErr: true},
+		{in: "NaN", wantErr: true},
+		{in: "nan", wantErr: true},
+		{in: "inf", wantErr: true},
+		{in: "+Inf", wantErr: true},
+		{in: "-Inf", wantErr: true},
+		{in: "1e300", wantErr: true},
+		{in: "9223372037", wantErr: true},
+		{in: "NaN:00", wantErr: true},
+		{in: "1e300:00", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseOffset(tt.in)
+		if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+			t.Errorf("parseOffset(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestParseTimeRange(t *testing.T) {
+	tests := []struct {
+		query      string
+		start, end time.Duration
+		wantErr    bool
+	}{
+		{query: ""},
+		{query: "start=10", start: 10 * time.Second},
+		{query: "start=10&end=20", start: 10 * time.Second, end: 20 * time.Second},
+		{query: "end=1:00", end: time.Minute},
+		{query: "start=20&end=10", wantErr: true},
+		{query: "start=10&end=10", wantErr: true},
+		{query: "start=NaN", wantErr: true},
+		{query: "end=inf", wantErr: true},
+	}
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		start, end, err := parseTimeRange(query)
+		if (err != nil) != tt.wantErr || start != tt.start || end != tt.end {
+			t.Errorf("parseTimeRange(%q) = %v, %v, %v", tt.query, start, end, err)
+		}
+	}
+}
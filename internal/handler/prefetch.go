@@ -0,0 +1,258 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/autoslides/video-proxy/internal/cache"
+	"github.com/autoslides/video-proxy/internal/crypto"
+	"github.com/autoslides/video-proxy/internal/m3u8"
+	"github.com/autoslides/video-proxy/internal/metrics"
+	"github.com/autoslides/video-proxy/internal/proxy"
+	"github.com/autoslides/video-proxy/internal/token"
+)
+
+const (
+	// Playlists not refreshed for this long are forgotten
+	playlistTTL = 10 * time.Minute
+)
+
+var prefetches = metrics.NewCounterVec(
+	"proxy_prefetch_segments_total",
+	"Segments prefetched into the cache by result",
+	"result",
+)
+
+// playlistIndex is the segment order of a media playlist
+type playlistIndex struct {
+	segments []segmentRef   // in playlist order
+	position map[string]int // key: segmentKey
+	updated  time.Time
+}
+
+// segmentRef locates a segment upstream
+type segmentRef struct {
+	url       string          // absolute segment URL
+	byteRange *m3u8.ByteRange // nil for the whole file
+}
+
+// prefetchSession tracks one viewer's progress through a playlist
+type prefetchSession struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	position int // index of the last segment the viewer requested
+	lastSeen time.Time
+}
+
+// Prefetcher downloads the segments following the one a viewer just
+// requested into the segment cache, so the next requests are served
+// from memory
+type Prefetcher struct {
+	upstream
+	cache *cache.Cache
+	ahead int           // Segments to fetch past the requested one
+	sem   chan struct{} // Bounds concurrent prefetches across viewers
+	idle  time.Duration // Cancel a viewer's prefetches after this long without requests
+
+	mu        sync.Mutex
+	playlists map[string]*playlistIndex   // key: playlist URL
+	sessions  map[string]*prefetchSession // key: login token + playlist URL
+	inflight  map[string]chan struct{}    // key: segmentKey, closed when done
+}
+
+// NewPrefetcher creates a prefetcher. With no cache or ahead of zero or
+// less prefetching is disabled and nil is returned, which the handlers
+// treat as a no-op.
+func NewPrefetcher(
+	crypto *crypto.Crypto,
+	tokenCache *token.TokenCache,
+	client *proxy.Client,
+	videoHost string,
+	segmentCache *cache.Cache,
+	ahead, concurrency int,
+	idle time.Duration,
+) *Prefetcher {
+	if segmentCache == nil || ahead <= 0 {
+		return nil
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if idle <= 0 {
+		idle = 30 * time.Second
+	}
+
+	p := &Prefetcher{
+		upstream: upstream{
+			crypto:     crypto,
+			tokenCache: tokenCache,
+			client:     client,
+			videoHost:  videoHost,
+		},
+		cache:     segmentCache,
+		ahead:     ahead,
+		sem:       make(chan struct{}, concurrency),
+		idle:      idle,
+		playlists: make(map[string]*playlistIndex),
+		sessions:  make(map[string]*prefetchSession),
+		inflight:  make(map[string]chan struct{}),
+	}
+	go p.cleanup()
+	return p
+}
+
+// record remembers the segment order of a media playlist fetched from
+// playlistURL. Master playlists are ignored.
+func (p *Prefetcher) record(playlistURL string, playlist *m3u8.Playlist) {
+	if p == nil || playlist.Master || len(playlist.Segments) == 0 {
+		return
+	}
+
+	segments := playlist.Segments
+	index := &playlistIndex{
+		segments: make([]segmentRef, len(segments)),
+		position: make(map[string]int, len(segments)),
+		updated:  time.Now(),
+	}
+	for i, seg := range segments {
+		ref := segmentRef{url: resolveURL(playlistURL, seg.URI), byteRange: seg.ByteRange}
+		index.segments[i] = ref
+		index.position[segmentKey(ref.url, ref.byteRange)] = i
+	}
+
+	p.mu.Lock()
+	p.playlists[playlistURL] = index
+	p.mu.Unlock()
+}
+
+// lookup returns a cached segment by its segmentKey, waiting for a
+// prefetch of it that is already in flight
+func (p *Prefetcher) lookup(ctx context.Context, key string) (cache.Entry, bool) {
+	if p == nil {
+		return cache.Entry{}, false
+	}
+
+	p.mu.Lock()
+	done, ok := p.inflight[key]
+	p.mu.Unlock()
+
+	if ok {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return cache.Entry{}, false
+		}
+	}
+
+	return p.cache.Get(key)
+}
+
+// schedule prefetches the segments following the one with segmentKey
+// segKey in the playlist at playlistURL. A viewer that jumps outside the
+// current window (seeking) cancels the prefetches still running for the
+// old position.
+func (p *Prefetcher) schedule(loginToken, playlistURL, segKey string, mode networkMode) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	index, ok := p.playlists[playlistURL]
+	if !ok {
+		return
+	}
+	position, ok := index.position[segKey]
+	if !ok {
+		return
+	}
+
+	key := loginToken + "|" + playlistURL
+	session, ok := p.sessions[key]
+	if ok && (position < session.position || position > session.position+p.ahead+1) {
+		session.cancel()
+		ok = false
+	}
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		session = &prefetchSession{ctx: ctx, cancel: cancel}
+		p.sessions[key] = session
+	}
+	session.position = position
+	session.lastSeen = time.Now()
+
+	last := position + p.ahead
+	if last >= len(index.segments) {
+		last = len(index.segments) - 1
+	}
+	for i := position + 1; i <= last; i++ {
+		ref := index.segments[i]
+		segKey := segmentKey(ref.url, ref.byteRange)
+		if _, busy := p.inflight[segKey]; busy || p.cache.Contains(segKey) {
+			continue
+		}
+		done := make(chan struct{})
+		p.inflight[segKey] = done
+		go p.fetch(session.ctx, ref, loginToken, mode, done)
+	}
+}
+
+// fetch downloads one segment into the cache
+func (p *Prefetcher) fetch(ctx context.Context, ref segmentRef, loginToken string, mode networkMode, done chan struct{}) {
+	key := segmentKey(ref.url, ref.byteRange)
+	defer func() {
+		p.mu.Lock()
+		delete(p.inflight, key)
+		p.mu.Unlock()
+		close(done)
+	}()
+
+	select {
+	case p.sem <- struct{}{}:
+		defer func() { <-p.sem }()
+	case <-ctx.Done():
+		prefetches.With("cancelled").Inc()
+		return
+	}
+
+	data, header, err := p.fetchSegment(ctx, ref.url, ref.byteRange, loginToken, mode)
+	if err != nil {
+		if ctx.Err() != nil {
+			prefetches.With("cancelled").Inc()
+			return
+		}
+		prefetches.With("failed").Inc()
+		log.Printf("Failed to prefetch TS: %v", err)
+		return
+	}
+
+	p.cache.Set(key, cache.Entry{Data: data, ContentType: header.Get("Content-Type")})
+	prefetches.With("fetched").Inc()
+}
+
+// cleanup cancels the prefetches of viewers that stopped requesting
+// segments and forgets playlists nobody has refreshed
+func (p *Prefetcher) cleanup() {
+	ticker := time.NewTicker(p.idle / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		p.mu.Lock()
+		for key, session := range p.sessions {
+			if now.Sub(session.lastSeen) > p.idle {
+				session.cancel()
+				delete(p.sessions, key)
+			}
+		}
+		for key, index := range p.playlists {
+			if now.Sub(index.updated) > playlistTTL {
+				delete(p.playlists, key)
+			}
+		}
+		p.mu.Unlock()
+	}
+}
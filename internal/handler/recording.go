@@ -0,0 +1,211 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/autoslides/video-proxy/internal/archive"
+)
+
+type RecordingHandler struct {
+	archive *archive.Manager
+}
+
+func NewRecordingHandler(archive *archive.Manager) *RecordingHandler {
+	return &RecordingHandler{archive: archive}
+}
+
+// recordingRequest is the body of POST /api/v1/recordings and
+// POST /api/v1/recordings/schedules
+type recordingRequest struct {
+	URL      string `json:"url"`
+	Token    string `json:"token"`
+	Mode     string `json:"mode"`     // "external" (default), "intranet" or "auto"
+	Start    string `json:"start"`    // RFC 3339; defaults to now
+	End      string `json:"end"`      // RFC 3339; or give a duration
+	Duration string `json:"duration"` // e.g. "1h35m"
+	Cron     string `json:"cron"`     // Schedules only, e.g. "0 8 * * 1"
+}
+
+// ServeHTTP handles the recording API:
+//
+//	POST   /api/v1/recordings                  record a live playlist once
+//	GET    /api/v1/recordings                  list recordings
+//	GET    /api/v1/recordings/{id}             recording status
+//	DELETE /api/v1/recordings/{id}             stop a recording early
+//	POST   /api/v1/recordings/schedules        record at every cron match
+//	GET    /api/v1/recordings/schedules        list schedules
+//	DELETE /api/v1/recordings/schedules/{id}   remove a schedule
+func (h *RecordingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/recordings"), "/")
+	if path == "schedules" || strings.HasPrefix(path, "schedules/") {
+		h.serveSchedules(w, r, strings.TrimPrefix(strings.TrimPrefix(path, "schedules"), "/"))
+		return
+	}
+
+	id := path
+	switch {
+	case id == "" && r.Method == "POST":
+		h.record(w, r)
+	case id == "" && r.Method == "GET":
+		json.NewEncoder(w).Encode(h.archive.List(archive.KindRecording))
+	case id != "" && r.Method == "GET":
+		job, ok := h.archive.Get(archive.KindRecording, id)
+		if !ok {
+			http.Error(w, "Recording not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(job)
+	case id != "" && r.Method == "DELETE":
+		if _, ok := h.archive.Get(archive.KindRecording, id); !ok {
+			http.Error(w, "Recording not found", http.StatusNotFound)
+			return
+		}
+		if !h.archive.Stop(id) {
+			http.Error(w, "Recording already finished", http.StatusConflict)
+			return
+		}
+		log.Printf("Stopping recording %s", id)
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *RecordingHandler) serveSchedules(w http.ResponseWriter, r *http.Request, id string) {
+	switch {
+	case id == "" && r.Method == "POST":
+		h.schedule(w, r)
+	case id == "" && r.Method == "GET":
+		json.NewEncoder(w).Encode(h.archive.Schedules())
+	case id != "" && r.Method == "DELETE":
+		removed, err := h.archive.RemoveSchedule(id)
+		if err != nil {
+			log.Printf("Failed to save recording schedules: %v", err)
+			http.Error(w, "Failed to remove schedule", http.StatusInternalServerError)
+			return
+		}
+		if !removed {
+			http.Error(w, "Schedule not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Removed recording schedule %s", id)
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *RecordingHandler) record(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeRecordingRequest(w, r)
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	if req.Start != "" {
+		t, err := time.Parse(time.RFC3339, req.Start)
+		if err != nil {
+			http.Error(w, "Invalid start time", http.StatusBadRequest)
+			return
+		}
+		start = t
+	}
+
+	var end time.Time
+	switch {
+	case req.End != "":
+		t, err := time.Parse(time.RFC3339, req.End)
+		if err != nil {
+			http.Error(w, "Invalid end time", http.StatusBadRequest)
+			return
+		}
+		end = t
+	case req.Duration != "":
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid duration", http.StatusBadRequest)
+			return
+		}
+		end = start.Add(d)
+	default:
+		http.Error(w, "Missing required field: end or duration", http.StatusBadRequest)
+		return
+	}
+	if !end.After(start) || !end.After(time.Now()) {
+		http.Error(w, "End must be after start and in the future", http.StatusBadRequest)
+		return
+	}
+
+	job, err := h.archive.Record(req.URL, req.Token, req.Mode, start, end)
+	if err != nil {
+		log.Printf("Failed to schedule recording: %v", err)
+		http.Error(w, "Failed to schedule recording", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func (h *RecordingHandler) schedule(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeRecordingRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Cron == "" || req.Duration == "" {
+		http.Error(w, "Missing required fields: cron and duration", http.StatusBadRequest)
+		return
+	}
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration <= 0 {
+		http.Error(w, "Invalid duration", http.StatusBadRequest)
+		return
+	}
+
+	schedule, err := h.archive.AddSchedule(req.URL, req.Token, req.Mode, req.Cron, duration)
+	if err != nil {
+		if errors.Is(err, archive.ErrInvalidCron) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed to add recording schedule: %v", err)
+		http.Error(w, "Failed to add schedule", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Added recording schedule %s (%s for %s) for %s", schedule.ID, schedule.Cron, schedule.Duration, schedule.URL)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// decodeRecordingRequest reads and validates the fields shared by
+// recordings and schedules, writing an error response on failure
+func decodeRecordingRequest(w http.ResponseWriter, r *http.Request) (recordingRequest, bool) {
+	var req recordingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return req, false
+	}
+	if req.URL == "" || req.Token == "" {
+		http.Error(w, "Missing required fields: url and token", http.StatusBadRequest)
+		return req, false
+	}
+	if req.Mode == "" {
+		req.Mode = string(modeExternal)
+	}
+	if !validMode(req.Mode) {
+		http.Error(w, "Invalid mode", http.StatusBadRequest)
+		return req, false
+	}
+
+	// Fix URL escaping
+	req.URL = strings.ReplaceAll(req.URL, "\\/", "/")
+	return req, true
+}
@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/autoslides/video-proxy/internal/proxy"
+)
+
+// responseTracker records whether the response has started, so an error
+// after streaming began isn't followed by a second status line
+type responseTracker struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (t *responseTracker) WriteHeader(status int) {
+	t.started = true
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *responseTracker) Write(p []byte) (int, error) {
+	t.started = true
+	return t.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (t *responseTracker) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// upstreamErrorStatus maps an upstream failure to the status for the viewer
+func upstreamErrorStatus(err error) int {
+	if errors.Is(err, proxy.ErrCircuitOpen) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/autoslides/video-proxy/internal/m3u8"
+)
+
+// SeekHandler resolves a playback position to the segment containing it
+type SeekHandler struct {
+	stream *StreamHandler // Fetches, archives and rewrites like /stream
+}
+
+func NewSeekHandler(stream *StreamHandler) *SeekHandler {
+	return &SeekHandler{stream: stream}
+}
+
+// seekResult is the response of /seek
+type seekResult struct {
+	URL       string          `json:"url"`      // Proxied segment URL
+	Index     int             `json:"index"`    // Position in the playlist
+	Sequence  int64           `json:"sequence"` // Media sequence number
+	Start     float64         `json:"start"`    // Seconds from the first segment
+	Duration  float64         `json:"duration"` // Seconds
+	Offset    float64         `json:"offset"`   // Seconds into the segment
+	ByteRange *m3u8.ByteRange `json:"byte_range,omitempty"`
+	Path      string          `json:"path"` // "intranet", "external" or "archive"
+}
+
+// ServeHTTP handles /external/seek, /intranet/seek and /auto/seek. The t
+// parameter takes the same positions as start on /stream. With
+// redirect=true the response redirects to the segment instead.
+func (h *SeekHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Determine mode from path
+	mode := modeFromPath(r.URL.Path)
+
+	// Parse query parameters
+	originalURL := r.URL.Query().Get("url")
+	loginToken := r.URL.Query().Get("token")
+	position := r.URL.Query().Get("t")
+
+	if originalURL == "" || loginToken == "" || position == "" {
+		http.Error(w, "Missing required parameters: url, token and t", http.StatusBadRequest)
+		return
+	}
+
+	t, err := parseOffset(position)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	redirect := false
+	if value := r.URL.Query().Get("redirect"); value != "" {
+		if redirect, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "Invalid redirect", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Fix URL escaping
+	originalURL = strings.ReplaceAll(originalURL, "\\/", "/")
+
+	mediaURL, playlist, proxyPath, err := h.playlist(r, originalURL, loginToken, mode)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		log.Printf("Failed to fetch M3U8 for seek: %v", err)
+		writePlaylistError(w, err)
+		return
+	}
+
+	selected, start := selectRange(playlist.Segments, t, 0)
+	if len(selected) == 0 {
+		http.Error(w, "Requested time is outside the recording", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	seg := selected[0]
+	index := len(playlist.Segments) - len(selected)
+	segmentURL := segmentProxyURL(h.stream.proxyPrefix(r, mode), seg.URI, seg.ByteRange, mediaURL, loginToken)
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Proxy-Path")
+	w.Header().Set("X-Proxy-Path", proxyPath)
+	if redirect {
+		http.Redirect(w, r, segmentURL, http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(seekResult{
+		URL:       segmentURL,
+		Index:     index,
+		Sequence:  playlist.MediaSequence + int64(index),
+		Start:     start.Seconds(),
+		Duration:  seg.Duration,
+		Offset:    (t - start).Seconds(),
+		ByteRange: seg.ByteRange,
+		Path:      proxyPath,
+	})
+}
+
+// playlist returns the media playlist /stream would serve for
+// originalURL, resolving a master playlist to its best variant
+func (h *SeekHandler) playlist(r *http.Request, originalURL, loginToken string, mode networkMode) (string, *m3u8.Playlist, string, error) {
+	if mediaURL, content, ok := h.stream.archive.Playlist(originalURL); ok {
+		if err := h.stream.authorize(r.Context(), loginToken); err != nil {
+			return "", nil, "", err
+		}
+		playlist, err := m3u8.Parse(content)
+		if err != nil {
+			return "", nil, "", fmt.Errorf("%w: archived: %w", errInvalidPlaylist, err)
+		}
+		return mediaURL, playlist, "archive", nil
+	}
+
+	mediaURL, playlist, usedIntranet, err := h.stream.fetchMediaPlaylist(r.Context(), originalURL, loginToken, mode)
+	if err != nil {
+		return "", nil, "", err
+	}
+	playlist = h.stream.live.accumulate(mediaURL, playlist)
+	return mediaURL, playlist, pathName(usedIntranet), nil
+}
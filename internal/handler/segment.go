@@ -1,21 +1,27 @@
 package handler
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
 
+	"github.com/autoslides/video-proxy/internal/archive"
 	"github.com/autoslides/video-proxy/internal/crypto"
+	"github.com/autoslides/video-proxy/internal/m3u8"
 	"github.com/autoslides/video-proxy/internal/proxy"
+	"github.com/autoslides/video-proxy/internal/ratelimit"
 	"github.com/autoslides/video-proxy/internal/token"
 )
 
 type SegmentHandler struct {
-	crypto     *crypto.Crypto
-	tokenCache *token.TokenCache
-	client     *proxy.Client
-	videoHost  string
+	upstream
+	throttle   *ratelimit.Throttle // Optional bandwidth caps for segment bodies
+	prefetcher *Prefetcher         // Optional read-ahead into the segment cache
+	archive    *archive.Manager    // Optional; serves archived segments from disk
 }
 
 func NewSegmentHandler(
@@ -25,19 +31,37 @@ func NewSegmentHandler(
 	videoHost string,
 ) *SegmentHandler {
 	return &SegmentHandler{
-		crypto:     crypto,
-		tokenCache: tokenCache,
-		client:     client,
-		videoHost:  videoHost,
+		upstream: upstream{
+			crypto:     crypto,
+			tokenCache: tokenCache,
+			client:     client,
+			videoHost:  videoHost,
+		},
 	}
 }
 
-// ServeHTTP handles both /external/ts/{path} and /intranet/ts/{path}
+// SetThrottle sets the bandwidth throttle applied to segment bodies
+func (h *SegmentHandler) SetThrottle(t *ratelimit.Throttle) {
+	h.throttle = t
+}
+
+// SetPrefetcher serves cached segments and prefetches the following ones
+func (h *SegmentHandler) SetPrefetcher(p *Prefetcher) {
+	h.prefetcher = p
+}
+
+// SetArchive serves archived segments without contacting the upstream
+func (h *SegmentHandler) SetArchive(a *archive.Manager) {
+	h.archive = a
+}
+
+// ServeHTTP handles /external/ts/{path}, /intranet/ts/{path} and /auto/ts/{path}
 func (h *SegmentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Set CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Proxy-Path, X-Cache")
 
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
@@ -45,15 +69,10 @@ func (h *SegmentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Determine mode from path
-	isIntranet := strings.HasPrefix(r.URL.Path, "/intranet/")
+	mode := modeFromPath(r.URL.Path)
 
 	// Extract TS filename from path
-	var tsFileName string
-	if isIntranet {
-		tsFileName = strings.TrimPrefix(r.URL.Path, "/intranet/ts/")
-	} else {
-		tsFileName = strings.TrimPrefix(r.URL.Path, "/external/ts/")
-	}
+	tsFileName := strings.TrimPrefix(r.URL.Path, "/"+string(mode)+"/ts/")
 
 	// URL decode the filename
 	tsFileName, err := url.PathUnescape(tsFileName)
@@ -71,51 +90,122 @@ func (h *SegmentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Segments packed into one file carry their byte range
+	var byteRange *m3u8.ByteRange
+	if value := r.URL.Query().Get("range"); value != "" {
+		if byteRange, err = m3u8.ParseByteRange(value); err != nil {
+			http.Error(w, "Invalid range", http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Build full TS URL
-	tsURL := h.resolveURL(baseURL, tsFileName)
+	tsURL := resolveURL(baseURL, tsFileName)
+	segKey := segmentKey(tsURL, byteRange)
 
-	// Get video token
-	videoToken, err := h.tokenCache.GetVideoToken(loginToken)
-	if err != nil {
-		log.Printf("Failed to get video token: %v", err)
-		http.Error(w, "Failed to get video token", http.StatusInternalServerError)
+	if h.serveArchived(w, r, tsURL, byteRange, loginToken) {
 		return
 	}
 
-	// Build signed URL function (for retry with fresh signature)
-	buildSignedURL := func() string {
-		encryptedURL := h.crypto.EncryptURL(tsURL)
-		return h.crypto.SignURL(encryptedURL, videoToken)
-	}
-
-	// Proxy TS with retry logic
-	err = h.client.ProxyTSWithRetry(
-		buildSignedURL,
-		w,
-		isIntranet,
-		h.videoHost,
-		func(attempt int) error {
-			log.Printf("TS request retry %d, refreshing token", attempt+1)
-			// Invalidate and refresh token
-			h.tokenCache.InvalidateToken(loginToken)
-			newToken, err := h.tokenCache.GetVideoToken(loginToken)
-			if err != nil {
-				return err
-			}
-			videoToken = newToken
-			return nil
-		},
+	if h.serveCached(w, r, segKey, loginToken) {
+		h.prefetcher.schedule(loginToken, baseURL, segKey, mode)
+		return
+	}
+
+	// Proxy TS with retry logic (and fallback in auto mode)
+	tracker := &responseTracker{ResponseWriter: w}
+	_, err = h.proxySegment(
+		r.Context(),
+		h.throttle.Wrap(r.Context(), tracker, loginToken),
+		tracker,
+		tsURL,
+		byteRange,
+		loginToken,
+		mode,
 	)
 
 	if err != nil {
+		if r.Context().Err() != nil {
+			// Viewer seeked or closed the player; upstream work was cancelled
+			return
+		}
 		log.Printf("Failed to proxy TS: %v", err)
 		// Only write error if headers haven't been sent
 		// (the proxy client might have already started writing)
+		if tracker.started {
+			return
+		}
+		if errors.Is(err, errVideoToken) {
+			http.Error(w, "Failed to get video token", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Failed to fetch TS segment", upstreamErrorStatus(err))
+		return
 	}
+
+	h.prefetcher.schedule(loginToken, baseURL, segKey, mode)
+}
+
+// serveCached writes a prefetched segment if one is cached under segKey.
+// The login token is checked first so the cache never serves
+// unauthenticated viewers.
+func (h *SegmentHandler) serveCached(w http.ResponseWriter, r *http.Request, segKey, loginToken string) bool {
+	if h.prefetcher == nil {
+		return false
+	}
+	if h.authorize(r.Context(), loginToken) != nil {
+		return false
+	}
+
+	entry, ok := h.prefetcher.lookup(r.Context(), segKey)
+	if !ok {
+		return false
+	}
+
+	contentType := entry.ContentType
+	if contentType == "" {
+		contentType = "video/mp2t"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.Data)))
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(http.StatusOK)
+	h.throttle.Wrap(r.Context(), w, loginToken).Write(entry.Data)
+	return true
+}
+
+// serveArchived writes a segment from the archive if it holds one. Like
+// serveCached it checks the login token first. Range requests are honored
+// since the whole file is at hand.
+func (h *SegmentHandler) serveArchived(w http.ResponseWriter, r *http.Request, tsURL string, byteRange *m3u8.ByteRange, loginToken string) bool {
+	path, ok := h.archive.Segment(tsURL, byteRange)
+	if !ok {
+		return false
+	}
+	if h.authorize(r.Context(), loginToken) != nil {
+		return false
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Failed to open archived TS: %v", err)
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		log.Printf("Failed to open archived TS: %v", err)
+		return false
+	}
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Header().Set("X-Proxy-Path", "archive")
+	http.ServeContent(h.throttle.Wrap(r.Context(), w, loginToken), r, "", info.ModTime(), f)
+	return true
 }
 
 // resolveURL resolves a relative URL against a base URL
-func (h *SegmentHandler) resolveURL(base, relative string) string {
+func resolveURL(base, relative string) string {
 	if strings.HasPrefix(relative, "http") {
 		return relative
 	}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/autoslides/video-proxy/internal/m3u8"
+)
+
+// maxStitchParts bounds how many playlists one stitch request may combine
+const maxStitchParts = 20
+
+// StitchHandler combines several recording sessions into one VOD playlist
+type StitchHandler struct {
+	stream *StreamHandler // Fetches, archives and rewrites each part
+}
+
+func NewStitchHandler(stream *StreamHandler) *StitchHandler {
+	return &StitchHandler{stream: stream}
+}
+
+// stitchPart is one fetched playlist of a stitch request
+type stitchPart struct {
+	playlist  *m3u8.Playlist // Rewritten media playlist
+	proxyPath string
+	err       error
+}
+
+// ServeHTTP handles /external/stitch, /intranet/stitch and /auto/stitch.
+// Each url parameter is one part; the parts are joined in order with
+// EXT-X-DISCONTINUITY between them.
+func (h *StitchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Determine mode from path
+	mode := modeFromPath(r.URL.Path)
+
+	// Parse query parameters
+	urls := r.URL.Query()["url"]
+	loginToken := r.URL.Query().Get("token")
+
+	if len(urls) == 0 || loginToken == "" {
+		http.Error(w, "Missing required parameters: url and token", http.StatusBadRequest)
+		return
+	}
+	if len(urls) > maxStitchParts {
+		http.Error(w, fmt.Sprintf("At most %d playlists can be stitched", maxStitchParts), http.StatusBadRequest)
+		return
+	}
+
+	// Archived parts are read without the upstream, so the token is
+	// checked once for all parts
+	if err := h.stream.authorize(r.Context(), loginToken); err != nil {
+		if r.Context().Err() == nil {
+			log.Printf("Failed to get video token for stitch: %v", err)
+			writePlaylistError(w, err)
+		}
+		return
+	}
+
+	// Parts are fetched in parallel so a long course day loads quickly
+	parts := make([]stitchPart, len(urls))
+	var wg sync.WaitGroup
+	for i, originalURL := range urls {
+		wg.Add(1)
+		go func(i int, originalURL string) {
+			defer wg.Done()
+			// Fix URL escaping
+			originalURL = strings.ReplaceAll(originalURL, "\\/", "/")
+			parts[i] = h.part(r, originalURL, loginToken, mode)
+		}(i, originalURL)
+	}
+	wg.Wait()
+
+	if r.Context().Err() != nil {
+		return
+	}
+	playlists := make([]*m3u8.Playlist, len(parts))
+	proxyPaths := make([]string, 0, len(parts))
+	for i, part := range parts {
+		if part.err != nil {
+			log.Printf("Failed to fetch M3U8 for stitch part %d of %d: %v", i+1, len(parts), part.err)
+			writePlaylistError(w, part.err)
+			return
+		}
+		playlists[i] = part.playlist
+		if !slices.Contains(proxyPaths, part.proxyPath) {
+			proxyPaths = append(proxyPaths, part.proxyPath)
+		}
+	}
+
+	writePlaylist(w, stitchPlaylists(playlists).String(), strings.Join(proxyPaths, ", "))
+}
+
+// part fetches one media playlist, from the archive when it is there, and
+// rewrites its URIs relative to its own URL
+func (h *StitchHandler) part(r *http.Request, originalURL, loginToken string, mode networkMode) stitchPart {
+	if mediaURL, content, ok := h.stream.archive.Playlist(originalURL); ok {
+		playlist, err := m3u8.Parse(content)
+		if err != nil {
+			return stitchPart{err: fmt.Errorf("%w: archived: %w", errInvalidPlaylist, err)}
+		}
+		h.stream.rewritePlaylist(playlist, mediaURL, loginToken, mode, r)
+		return stitchPart{playlist: playlist, proxyPath: "archive"}
+	}
+
+	mediaURL, playlist, usedIntranet, err := h.stream.fetchMediaPlaylist(r.Context(), originalURL, loginToken, mode)
+	if err != nil {
+		return stitchPart{err: err}
+	}
+	h.stream.prefetcher.record(mediaURL, playlist)
+	h.stream.rewritePlaylist(playlist, mediaURL, loginToken, mode, r)
+	return stitchPart{playlist: playlist, proxyPath: pathName(usedIntranet)}
+}
+
+// stitchPlaylists joins media playlists into one VOD playlist. The header
+// takes the highest version and target duration of the parts, and every
+// part after the first starts with EXT-X-DISCONTINUITY. A part without
+// encryption that follows an encrypted one gets METHOD=NONE so it does
+// not inherit the previous key.
+func stitchPlaylists(parts []*m3u8.Playlist) *m3u8.Playlist {
+	stitched := &m3u8.Playlist{PlaylistType: "VOD", EndList: true}
+	keyed := false // The last key seen encrypts
+	for i, part := range parts {
+		stitched.Version = max(stitched.Version, part.Version)
+		stitched.TargetDuration = max(stitched.TargetDuration, part.TargetDuration)
+		for j, seg := range part.Segments {
+			if i > 0 && j == 0 {
+				seg.Discontinuity = true
+				if keyed && seg.Key == nil {
+					seg.Key = &m3u8.Key{Method: "NONE"}
+				}
+			}
+			if seg.Key != nil {
+				keyed = seg.Key.Method != "NONE"
+			}
+			stitched.Segments = append(stitched.Segments, seg)
+		}
+	}
+	return stitched
+}
@@ -1,23 +1,27 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/autoslides/video-proxy/internal/archive"
 	"github.com/autoslides/video-proxy/internal/crypto"
+	"github.com/autoslides/video-proxy/internal/m3u8"
 	"github.com/autoslides/video-proxy/internal/proxy"
 	"github.com/autoslides/video-proxy/internal/token"
 )
 
 type StreamHandler struct {
-	crypto     *crypto.Crypto
-	tokenCache *token.TokenCache
-	client     *proxy.Client
-	videoHost  string
-	serverHost string // The proxy server's host for rewriting URLs
+	upstream
+	serverHost string           // The proxy server's host for rewriting URLs
+	prefetcher *Prefetcher      // Optional; learns segment order from playlists
+	archive    *archive.Manager // Optional; serves archived playlists from disk
+	live       *LiveAccumulator // Optional; keeps segments that scrolled out of live playlists
 }
 
 func NewStreamHandler(
@@ -27,10 +31,12 @@ func NewStreamHandler(
 	videoHost string,
 ) *StreamHandler {
 	return &StreamHandler{
-		crypto:     crypto,
-		tokenCache: tokenCache,
-		client:     client,
-		videoHost:  videoHost,
+		upstream: upstream{
+			crypto:     crypto,
+			tokenCache: tokenCache,
+			client:     client,
+			videoHost:  videoHost,
+		},
 	}
 }
 
@@ -39,10 +45,27 @@ func (h *StreamHandler) SetServerHost(host string) {
 	h.serverHost = host
 }
 
-// ServeHTTP handles both /external/stream and /intranet/stream
+// SetPrefetcher shares fetched playlists with the segment prefetcher
+func (h *StreamHandler) SetPrefetcher(p *Prefetcher) {
+	h.prefetcher = p
+}
+
+// SetArchive serves archived lectures without contacting the upstream
+func (h *StreamHandler) SetArchive(a *archive.Manager) {
+	h.archive = a
+}
+
+// SetLiveAccumulator serves live playlists with every segment seen so far
+func (h *StreamHandler) SetLiveAccumulator(a *LiveAccumulator) {
+	h.live = a
+}
+
+// ServeHTTP handles /external/stream, /intranet/stream and /auto/stream.
+// Optional start and end parameters trim the playlist to the segments
+// overlapping that window.
 func (h *StreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Determine mode from path
-	isIntranet := strings.HasPrefix(r.URL.Path, "/intranet/")
+	mode := modeFromPath(r.URL.Path)
 
 	// Parse query parameters
 	originalURL := r.URL.Query().Get("url")
@@ -53,61 +76,150 @@ func (h *StreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	start, end, err := parseTimeRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Fix URL escaping
 	originalURL = strings.ReplaceAll(originalURL, "\\/", "/")
 
-	// Get video token (cached for 10s)
-	videoToken, err := h.tokenCache.GetVideoToken(loginToken)
-	if err != nil {
-		log.Printf("Failed to get video token: %v", err)
-		http.Error(w, "Failed to get video token", http.StatusInternalServerError)
+	// Archived lectures are served from disk; their segment URLs are
+	// relative to the media playlist the archive stored
+	if mediaURL, content, ok := h.archive.Playlist(originalURL); ok {
+		if err := h.authorize(r.Context(), loginToken); err != nil {
+			if r.Context().Err() == nil {
+				log.Printf("Failed to get video token: %v", err)
+				http.Error(w, "Failed to get video token", http.StatusInternalServerError)
+			}
+			return
+		}
+		playlist, err := m3u8.Parse(content)
+		if err != nil {
+			log.Printf("Invalid archived M3U8 for %s: %v", originalURL, err)
+			http.Error(w, "Invalid archived M3U8", http.StatusInternalServerError)
+			return
+		}
+		h.servePlaylist(w, r, playlist, mediaURL, loginToken, mode, start, end, "archive")
 		return
 	}
 
-	// Build signed URL function (for retry with fresh signature)
-	buildSignedURL := func() string {
-		encryptedURL := h.crypto.EncryptURL(originalURL)
-		return h.crypto.SignURL(encryptedURL, videoToken)
-	}
-
-	// Fetch M3U8 with retry logic
-	content, err := h.client.FetchM3U8WithRetry(
-		buildSignedURL,
-		isIntranet,
-		h.videoHost,
-		func(attempt int) error {
-			log.Printf("M3U8 request retry %d, refreshing token", attempt+1)
-			// Invalidate and refresh token
-			h.tokenCache.InvalidateToken(loginToken)
-			newToken, err := h.tokenCache.GetVideoToken(loginToken)
-			if err != nil {
-				return err
-			}
-			videoToken = newToken
-			return nil
-		},
-	)
+	// Fetch M3U8 with retry logic (and fallback in auto mode)
+	content, usedIntranet, err := h.fetchM3U8(r.Context(), originalURL, loginToken, mode)
 
 	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		if errors.Is(err, errVideoToken) {
+			log.Printf("Failed to get video token: %v", err)
+			http.Error(w, "Failed to get video token", http.StatusInternalServerError)
+			return
+		}
 		log.Printf("Failed to fetch M3U8: %v", err)
-		http.Error(w, "Failed to fetch M3U8", http.StatusBadGateway)
+		http.Error(w, "Failed to fetch M3U8", upstreamErrorStatus(err))
+		return
+	}
+
+	playlist, err := m3u8.Parse(content)
+	if err != nil {
+		log.Printf("Invalid M3U8 from %s: %v", originalURL, err)
+		http.Error(w, "Invalid M3U8", http.StatusBadGateway)
+		return
+	}
+
+	playlist = h.live.accumulate(originalURL, playlist)
+	h.prefetcher.record(originalURL, playlist)
+
+	h.servePlaylist(w, r, playlist, originalURL, loginToken, mode, start, end, pathName(usedIntranet))
+}
+
+// servePlaylist clips a playlist to the requested window, points its URIs
+// at the proxy and sends it
+func (h *StreamHandler) servePlaylist(
+	w http.ResponseWriter,
+	r *http.Request,
+	playlist *m3u8.Playlist,
+	baseURL, loginToken string,
+	mode networkMode,
+	start, end time.Duration,
+	proxyPath string,
+) {
+	// Trim to the requested window, measured from the first segment
+	if (start > 0 || end > 0) && !clipPlaylist(playlist, start, end) {
+		http.Error(w, "Requested range is outside the recording", http.StatusRequestedRangeNotSatisfiable)
 		return
 	}
 
-	// Rewrite TS URLs in M3U8 content
-	rewrittenContent := h.rewriteM3U8Content(string(content), originalURL, loginToken, isIntranet, r)
+	h.rewritePlaylist(playlist, baseURL, loginToken, mode, r)
+	writePlaylist(w, playlist.String(), proxyPath)
+}
 
+// writePlaylist sends a rewritten playlist, reporting where it came from
+// in X-Proxy-Path
+func writePlaylist(w http.ResponseWriter, content, proxyPath string) {
 	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Proxy-Path")
+	w.Header().Set("X-Proxy-Path", proxyPath)
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(rewrittenContent))
+	w.Write([]byte(content))
 }
 
-// rewriteM3U8Content rewrites TS segment URLs to point to our proxy
-func (h *StreamHandler) rewriteM3U8Content(content, baseURL, loginToken string, isIntranet bool, r *http.Request) string {
-	lines := strings.Split(content, "\n")
-	result := make([]string, 0, len(lines))
+// rewritePlaylist points every URI of a playlist at the proxy. Segments,
+// keys and initialization maps go through /ts/ relative to baseURL;
+// variant and rendition playlists go through /stream with their absolute
+// URL, keeping the requested time window.
+func (h *StreamHandler) rewritePlaylist(p *m3u8.Playlist, baseURL, loginToken string, mode networkMode, r *http.Request) {
+	prefix := h.proxyPrefix(r, mode)
+
+	segmentURL := func(uri string, byteRange *m3u8.ByteRange) string {
+		if !proxiable(uri) {
+			return uri
+		}
+		return segmentProxyURL(prefix, uri, byteRange, baseURL, loginToken)
+	}
+	playlistURL := func(uri string) string {
+		if !proxiable(uri) {
+			return uri
+		}
+		query := url.Values{}
+		query.Set("url", resolveURL(baseURL, uri))
+		query.Set("token", loginToken)
+		for _, param := range []string{"start", "end"} {
+			if value := r.URL.Query().Get(param); value != "" {
+				query.Set(param, value)
+			}
+		}
+		return prefix + "/stream?" + query.Encode()
+	}
+
+	for _, seg := range p.Segments {
+		// A byte range moves into the proxied URL, which serves just that part
+		if proxiable(seg.URI) {
+			seg.URI, seg.ByteRange = segmentURL(seg.URI, seg.ByteRange), nil
+		}
+		if seg.Key != nil && seg.Key.URI != "" {
+			seg.Key.URI = segmentURL(seg.Key.URI, nil)
+		}
+		if seg.Map != nil && proxiable(seg.Map.URI) {
+			seg.Map.URI, seg.Map.ByteRange = segmentURL(seg.Map.URI, seg.Map.ByteRange), nil
+		}
+	}
+	for _, v := range p.Variants {
+		v.URI = playlistURL(v.URI)
+	}
+	for _, rendition := range p.Renditions {
+		if rendition.URI != "" {
+			rendition.URI = playlistURL(rendition.URI)
+		}
+	}
+}
 
+// proxyPrefix returns the proxy's URL for the request's network mode, so
+// auto playlists keep using auto segments
+func (h *StreamHandler) proxyPrefix(r *http.Request, mode networkMode) string {
 	// Determine server host for proxy URLs
 	serverHost := h.serverHost
 	if serverHost == "" {
@@ -123,31 +235,34 @@ func (h *StreamHandler) rewriteM3U8Content(content, baseURL, loginToken string,
 		scheme = fwdProto
 	}
 
-	// Path prefix based on mode
-	pathPrefix := "/external/ts/"
-	if isIntranet {
-		pathPrefix = "/intranet/ts/"
-	}
-
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
-			result = append(result, line)
-			continue
-		}
+	return scheme + "://" + serverHost + "/" + string(mode)
+}
 
-		// This is a TS file reference
-		tsFileName := trimmed
-		proxyURL := fmt.Sprintf("%s://%s%s%s?base=%s&token=%s",
-			scheme,
-			serverHost,
-			pathPrefix,
-			url.PathEscape(tsFileName),
-			url.QueryEscape(baseURL),
-			url.QueryEscape(loginToken),
-		)
-		result = append(result, proxyURL)
+// segmentProxyURL returns the /ts/ URL that serves uri relative to
+// baseURL, or only byteRange of it if not nil
+func segmentProxyURL(prefix, uri string, byteRange *m3u8.ByteRange, baseURL, loginToken string) string {
+	proxied := fmt.Sprintf("%s/ts/%s?base=%s&token=%s",
+		prefix,
+		url.PathEscape(uri),
+		url.QueryEscape(baseURL),
+		url.QueryEscape(loginToken),
+	)
+	if byteRange != nil {
+		proxied += "&range=" + byteRange.String()
 	}
+	return proxied
+}
 
-	return strings.Join(result, "\n")
+// proxiable reports whether uri is fetched over HTTP, unlike data: URIs
+// and DRM key identifiers such as skd://
+func proxiable(uri string) bool {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	switch parsed.Scheme {
+	case "", "http", "https":
+		return true
+	}
+	return false
 }
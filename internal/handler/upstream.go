@@ -0,0 +1,329 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/autoslides/video-proxy/internal/crypto"
+	"github.com/autoslides/video-proxy/internal/m3u8"
+	"github.com/autoslides/video-proxy/internal/proxy"
+	"github.com/autoslides/video-proxy/internal/token"
+)
+
+var (
+	// errVideoToken marks failures to obtain a video token for a login token
+	errVideoToken = errors.New("failed to get video token")
+	// errMasterPlaylist marks a master playlist that lists no usable variant
+	errMasterPlaylist = errors.New("master playlist has no variants")
+	// errInvalidPlaylist marks an upstream response that is not a playlist
+	errInvalidPlaylist = errors.New("invalid playlist")
+	// errInvalidRange marks an end position at or before the start
+	errInvalidRange = errors.New("end must be after start")
+)
+
+// networkMode is the route family a request came in on
+type networkMode string
+
+const (
+	modeExternal networkMode = "external"
+	modeIntranet networkMode = "intranet"
+	modeAuto     networkMode = "auto" // intranet first, falling back to external
+)
+
+// modeFromPath determines the network mode from the route prefix
+func modeFromPath(path string) networkMode {
+	switch {
+	case strings.HasPrefix(path, "/intranet/"):
+		return modeIntranet
+	case strings.HasPrefix(path, "/auto/"):
+		return modeAuto
+	default:
+		return modeExternal
+	}
+}
+
+// pathName reports the network path used, for the X-Proxy-Path header
+func pathName(isIntranet bool) string {
+	if isIntranet {
+		return string(modeIntranet)
+	}
+	return string(modeExternal)
+}
+
+// upstream signs video URLs and fetches them through the proxy client,
+// refreshing the video token when the upstream rejects it
+type upstream struct {
+	crypto             *crypto.Crypto
+	tokenCache         *token.TokenCache
+	client             *proxy.Client
+	videoHost          string
+	autoPreferExternal bool // Auto mode tries external before intranet
+}
+
+// SetAutoPreferExternal makes auto mode try external before intranet
+func (u *upstream) SetAutoPreferExternal(preferExternal bool) {
+	u.autoPreferExternal = preferExternal
+}
+
+// paths returns the network paths (isIntranet) to try for a mode, in order
+func (u *upstream) paths(mode networkMode) []bool {
+	switch mode {
+	case modeIntranet:
+		return []bool{true}
+	case modeAuto:
+		if u.autoPreferExternal {
+			return []bool{false, true}
+		}
+		return []bool{true, false}
+	default:
+		return []bool{false}
+	}
+}
+
+// pathContext returns the context for trying the i-th of paths. Every
+// path but the last gives up on its first connection failure or timeout,
+// so auto mode falls back without waiting out the retry policy.
+func pathContext(ctx context.Context, i int, paths []bool) context.Context {
+	if i < len(paths)-1 {
+		return proxy.WithFallback(ctx)
+	}
+	return ctx
+}
+
+// fetchM3U8 fetches a playlist, falling back to the next network path in
+// auto mode when the first one is unreachable. It reports whether the
+// intranet path served the playlist.
+func (u *upstream) fetchM3U8(ctx context.Context, originalURL, loginToken string, mode networkMode) ([]byte, bool, error) {
+	var lastErr error
+	paths := u.paths(mode)
+
+	for i, isIntranet := range paths {
+		content, err := u.fetchM3U8Path(pathContext(ctx, i, paths), originalURL, loginToken, isIntranet)
+		if err == nil {
+			return content, isIntranet, nil
+		}
+		lastErr = err
+		if !u.shouldFallBack(ctx, err) || i == len(paths)-1 {
+			break
+		}
+		log.Printf("M3U8 %s path unreachable, falling back: %v", pathName(isIntranet), err)
+	}
+
+	return nil, false, lastErr
+}
+
+// mediaPlaylist fetches the playlist at originalURL and, for a master
+// playlist, the highest bandwidth variant. It returns the media playlist
+// URL, its segments and whether the intranet path served it.
+func (u *upstream) mediaPlaylist(ctx context.Context, originalURL, loginToken string, mode networkMode) (string, []*m3u8.Segment, bool, error) {
+	playlistURL, playlist, usedIntranet, err := u.fetchMediaPlaylist(ctx, originalURL, loginToken, mode)
+	if err != nil {
+		return "", nil, false, err
+	}
+	return playlistURL, playlist.Segments, usedIntranet, nil
+}
+
+// fetchMediaPlaylist is mediaPlaylist returning the whole parsed playlist
+// instead of its segments
+func (u *upstream) fetchMediaPlaylist(ctx context.Context, originalURL, loginToken string, mode networkMode) (string, *m3u8.Playlist, bool, error) {
+	content, usedIntranet, err := u.fetchM3U8(ctx, originalURL, loginToken, mode)
+	if err != nil {
+		return "", nil, false, err
+	}
+	playlist, err := m3u8.Parse(content)
+	if err != nil {
+		return "", nil, false, fmt.Errorf("%w: %w", errInvalidPlaylist, err)
+	}
+	if !playlist.Master {
+		return originalURL, playlist, usedIntranet, nil
+	}
+
+	variant, ok := bestVariant(playlist)
+	if !ok {
+		return "", nil, false, errMasterPlaylist
+	}
+	variantURL := resolveURL(originalURL, variant.URI)
+
+	content, err = u.fetchM3U8Path(ctx, variantURL, loginToken, usedIntranet)
+	if err != nil {
+		return "", nil, false, err
+	}
+	if playlist, err = m3u8.Parse(content); err != nil {
+		return "", nil, false, fmt.Errorf("%w: %w", errInvalidPlaylist, err)
+	}
+	if playlist.Master {
+		return "", nil, false, fmt.Errorf("%w: nested master playlist", errMasterPlaylist)
+	}
+	return variantURL, playlist, usedIntranet, nil
+}
+
+// proxySegment streams a segment to w, falling back like fetchM3U8 as long
+// as nothing has been written to the viewer yet. The tracker must wrap the
+// writer underneath w.
+func (u *upstream) proxySegment(
+	ctx context.Context,
+	w http.ResponseWriter,
+	tracker *responseTracker,
+	tsURL string,
+	byteRange *m3u8.ByteRange,
+	loginToken string,
+	mode networkMode,
+) (bool, error) {
+	var lastErr error
+	paths := u.paths(mode)
+
+	for i, isIntranet := range paths {
+		w.Header().Set("X-Proxy-Path", pathName(isIntranet))
+
+		err := u.proxySegmentPath(pathContext(ctx, i, paths), w, tsURL, byteRange, loginToken, isIntranet)
+		if err == nil {
+			return isIntranet, nil
+		}
+		lastErr = err
+		if tracker.started || !u.shouldFallBack(ctx, err) || i == len(paths)-1 {
+			break
+		}
+		log.Printf("TS %s path unreachable, falling back: %v", pathName(isIntranet), err)
+	}
+
+	return false, lastErr
+}
+
+// fetchSegment downloads a whole segment, or the byteRange part of it,
+// falling back between network paths like fetchM3U8
+func (u *upstream) fetchSegment(ctx context.Context, tsURL string, byteRange *m3u8.ByteRange, loginToken string, mode networkMode) ([]byte, http.Header, error) {
+	var (
+		data   []byte
+		header http.Header
+		err    error
+	)
+	paths := u.paths(mode)
+	for i, isIntranet := range paths {
+		data, header, err = u.fetchSegmentPath(pathContext(ctx, i, paths), tsURL, byteRange, loginToken, isIntranet)
+		if err == nil || !u.shouldFallBack(ctx, err) || i == len(paths)-1 {
+			break
+		}
+	}
+	return data, header, err
+}
+
+// fetchSegmentPath downloads a segment over one network path
+func (u *upstream) fetchSegmentPath(ctx context.Context, tsURL string, byteRange *m3u8.ByteRange, loginToken string, isIntranet bool) ([]byte, http.Header, error) {
+	videoToken, err := u.tokenCache.GetVideoToken(ctx, loginToken)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errVideoToken, err)
+	}
+
+	buildSignedURL := func() string {
+		encryptedURL := u.crypto.EncryptURL(tsURL)
+		return u.crypto.SignURL(encryptedURL, videoToken)
+	}
+
+	return u.client.FetchTSWithRetry(
+		ctx,
+		buildSignedURL,
+		clientRange(byteRange),
+		isIntranet,
+		u.videoHost,
+		u.refreshToken(ctx, "TS", loginToken, &videoToken),
+	)
+}
+
+// authorize checks the login token with the upstream. Content served
+// without contacting the upstream, such as archived lectures, must be
+// authorized first so the token is still what grants access.
+func (u *upstream) authorize(ctx context.Context, loginToken string) error {
+	if _, err := u.tokenCache.GetVideoToken(ctx, loginToken); err != nil {
+		return fmt.Errorf("%w: %v", errVideoToken, err)
+	}
+	return nil
+}
+
+// shouldFallBack reports whether another network path may succeed. Only
+// connection failures and timeouts qualify; an upstream that answered
+// with an error status would answer the same on the other path.
+func (u *upstream) shouldFallBack(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && !errors.Is(err, errVideoToken) && proxy.IsUnreachable(err)
+}
+
+func (u *upstream) fetchM3U8Path(ctx context.Context, originalURL, loginToken string, isIntranet bool) ([]byte, error) {
+	videoToken, err := u.tokenCache.GetVideoToken(ctx, loginToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errVideoToken, err)
+	}
+
+	// Build signed URL function (for retry with fresh signature)
+	buildSignedURL := func() string {
+		encryptedURL := u.crypto.EncryptURL(originalURL)
+		return u.crypto.SignURL(encryptedURL, videoToken)
+	}
+
+	return u.client.FetchM3U8WithRetry(
+		ctx,
+		buildSignedURL,
+		isIntranet,
+		u.videoHost,
+		u.refreshToken(ctx, "M3U8", loginToken, &videoToken),
+	)
+}
+
+func (u *upstream) proxySegmentPath(ctx context.Context, w http.ResponseWriter, tsURL string, byteRange *m3u8.ByteRange, loginToken string, isIntranet bool) error {
+	videoToken, err := u.tokenCache.GetVideoToken(ctx, loginToken)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errVideoToken, err)
+	}
+
+	// Build signed URL function (for retry with fresh signature)
+	buildSignedURL := func() string {
+		encryptedURL := u.crypto.EncryptURL(tsURL)
+		return u.crypto.SignURL(encryptedURL, videoToken)
+	}
+
+	return u.client.ProxyTSWithRetry(
+		ctx,
+		buildSignedURL,
+		clientRange(byteRange),
+		w,
+		isIntranet,
+		u.videoHost,
+		u.refreshToken(ctx, "TS", loginToken, &videoToken),
+	)
+}
+
+// refreshToken returns the retry callback that replaces *videoToken with
+// a freshly fetched one
+func (u *upstream) refreshToken(ctx context.Context, kind, loginToken string, videoToken *string) func(attempt int) error {
+	return func(attempt int) error {
+		log.Printf("%s request retry %d, refreshing token", kind, attempt+1)
+		// Invalidate and refresh token
+		u.tokenCache.InvalidateToken(loginToken)
+		newToken, err := u.tokenCache.GetVideoToken(ctx, loginToken)
+		if err != nil {
+			return err
+		}
+		*videoToken = newToken
+		return nil
+	}
+}
+
+// clientRange converts a playlist byte range for the proxy client; nil
+// selects the whole segment
+func clientRange(byteRange *m3u8.ByteRange) proxy.ByteRange {
+	if byteRange == nil {
+		return proxy.ByteRange{}
+	}
+	return proxy.ByteRange{Offset: byteRange.Offset, Length: byteRange.Length}
+}
+
+// segmentKey identifies a segment for caching. Segments packed into one
+// file share a URL and differ by byte range.
+func segmentKey(tsURL string, byteRange *m3u8.ByteRange) string {
+	if byteRange == nil {
+		return tsURL
+	}
+	return tsURL + "#" + byteRange.String()
+}
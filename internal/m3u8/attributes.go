@@ -0,0 +1,125 @@
+package m3u8
+
+import (
+	"slices"
+	"strings"
+)
+
+// Attribute is one NAME=VALUE pair of an attribute list
+type Attribute struct {
+	Name   string
+	Value  string // Without quotes
+	Quoted bool
+}
+
+// Attributes is an attribute list in the order it was written
+type Attributes []Attribute
+
+// ParseAttributes parses an attribute list such as
+// BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2"
+func ParseAttributes(s string) Attributes {
+	var attrs Attributes
+	for s != "" {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		attr := Attribute{Name: strings.TrimSpace(name)}
+		if strings.HasPrefix(rest, `"`) {
+			value, after, _ := strings.Cut(rest[1:], `"`)
+			attr.Value, attr.Quoted = value, true
+			_, rest, _ = strings.Cut(after, ",")
+		} else {
+			attr.Value, rest, _ = strings.Cut(rest, ",")
+			attr.Value = strings.TrimSpace(attr.Value)
+		}
+		attrs = append(attrs, attr)
+		s = rest
+	}
+	return attrs
+}
+
+// Get returns the value of the named attribute
+func (a Attributes) Get(name string) (string, bool) {
+	for _, attr := range a {
+		if attr.Name == name {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+// String writes the attribute list
+func (a Attributes) String() string {
+	var b strings.Builder
+	for i, attr := range a {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(attr.Name)
+		b.WriteByte('=')
+		if attr.Quoted {
+			b.WriteString(`"` + attr.Value + `"`)
+		} else {
+			b.WriteString(attr.Value)
+		}
+	}
+	return b.String()
+}
+
+// without returns the attributes not named in names
+func (a Attributes) without(names ...string) Attributes {
+	var rest Attributes
+	for _, attr := range a {
+		if !slices.Contains(names, attr.Name) {
+			rest = append(rest, attr)
+		}
+	}
+	return rest
+}
+
+// inOrder returns the attributes in the order of the same names in parsed,
+// followed by those parsed does not have
+func (a Attributes) inOrder(parsed Attributes) Attributes {
+	if len(parsed) == 0 {
+		return a
+	}
+	ordered := make(Attributes, 0, len(a))
+	for _, p := range parsed {
+		if i := slices.IndexFunc(a, func(attr Attribute) bool { return attr.Name == p.Name }); i >= 0 {
+			ordered = append(ordered, a[i])
+		}
+	}
+	for _, attr := range a {
+		if _, ok := parsed.Get(attr.Name); !ok {
+			ordered = append(ordered, attr)
+		}
+	}
+	return ordered
+}
+
+// attributeWriter builds an attribute list, skipping empty values
+type attributeWriter struct {
+	attrs Attributes
+}
+
+func (w *attributeWriter) quoted(name, value string) {
+	if value != "" {
+		w.attrs = append(w.attrs, Attribute{Name: name, Value: value, Quoted: true})
+	}
+}
+
+func (w *attributeWriter) plain(name, value string) {
+	if value != "" {
+		w.attrs = append(w.attrs, Attribute{Name: name, Value: value})
+	}
+}
+
+// flag writes YES when set, and NO where parsed spelled it out
+func (w *attributeWriter) flag(name string, set bool, parsed Attributes) {
+	if set {
+		w.plain(name, "YES")
+	} else if _, ok := parsed.Get(name); ok {
+		w.plain(name, "NO")
+	}
+}
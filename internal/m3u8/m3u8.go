@@ -0,0 +1,153 @@
+// Package m3u8 parses HLS playlists into typed structures and writes them
+// back out. Master and media playlists share the Playlist type. Tags and
+// attributes the package does not model are kept verbatim, and parsed tags
+// and attributes are written back in their original order and spelling,
+// so an unmodified playlist serializes to the same one. Byte ranges are the
+// exception: they are always written with an explicit offset.
+package m3u8
+
+import (
+	"errors"
+	"slices"
+)
+
+// ErrNotPlaylist is returned for content that does not start with #EXTM3U
+var ErrNotPlaylist = errors.New("m3u8: missing #EXTM3U header")
+
+// Playlist is a master or media playlist
+type Playlist struct {
+	Version             int
+	IndependentSegments bool
+	Tags                []string // Other playlist-level tags, e.g. EXT-X-START
+
+	order []string // Playlist-level tag names as parsed, "" for one of Tags
+
+	// Master playlists
+	Master     bool
+	Variants   []*Variant   // EXT-X-STREAM-INF and EXT-X-I-FRAME-STREAM-INF
+	Renditions []*Rendition // EXT-X-MEDIA
+
+	// Media playlists
+	TargetDuration        int
+	MediaSequence         int64
+	DiscontinuitySequence int64
+	PlaylistType          string // "", "EVENT" or "VOD"
+	IFramesOnly           bool
+	Segments              []*Segment
+	Trailer               []string // Tags after the last segment
+	EndList               bool
+}
+
+// Segment is a media segment with the tags that apply to it
+type Segment struct {
+	URI           string
+	Duration      float64 // EXTINF, in seconds
+	Title         string
+	ByteRange     *ByteRange // Sub-range of URI, with the offset resolved
+	Discontinuity bool
+	Key           *Key     // Set where an EXT-X-KEY precedes the segment
+	Map           *Map     // Set where an EXT-X-MAP precedes the segment
+	Tags          []string // Other tags before the segment, e.g. EXT-X-PROGRAM-DATE-TIME
+
+	order    []string // Tag names as parsed, "" for one of Tags
+	duration string   // EXTINF duration as parsed
+}
+
+// ByteRange is a sub-range of a resource
+type ByteRange struct {
+	Length int64 `json:"length"`
+	Offset int64 `json:"offset"`
+}
+
+// Key is an EXT-X-KEY. It applies to its segment and every following
+// segment up to the next key.
+type Key struct {
+	Method            string // "NONE", "AES-128" or "SAMPLE-AES"
+	URI               string
+	IV                string
+	KeyFormat         string
+	KeyFormatVersions string
+	Attributes        Attributes // Others
+
+	parsed Attributes // As parsed, for their order and spelling
+}
+
+// Map is an EXT-X-MAP, the initialization section of the segments up to
+// the next map
+type Map struct {
+	URI        string
+	ByteRange  *ByteRange
+	Attributes Attributes // Others
+
+	parsed Attributes // As parsed, for their order and spelling
+}
+
+// Variant is a rendition of a master playlist
+type Variant struct {
+	URI              string
+	IFrame           bool // EXT-X-I-FRAME-STREAM-INF
+	Bandwidth        int64
+	AverageBandwidth int64
+	Codecs           string
+	Resolution       string
+	FrameRate        float64
+	Audio            string // Rendition group IDs
+	Video            string
+	Subtitles        string
+	ClosedCaptions   string
+	Attributes       Attributes // Others, e.g. HDCP-LEVEL
+
+	parsed Attributes // As parsed, for their order and spelling
+}
+
+// Rendition is an alternative audio, video, subtitle or closed caption
+// rendition of a master playlist
+type Rendition struct {
+	Type       string // "AUDIO", "VIDEO", "SUBTITLES" or "CLOSED-CAPTIONS"
+	GroupID    string
+	Name       string
+	Language   string
+	URI        string // Empty for renditions muxed into the variant
+	Default    bool
+	Autoselect bool
+	Attributes Attributes // Others, e.g. CHANNELS
+
+	parsed Attributes // As parsed, for their order and spelling
+}
+
+// Duration returns the total EXTINF duration of the segments in seconds
+func (p *Playlist) Duration() float64 {
+	var total float64
+	for _, seg := range p.Segments {
+		total += seg.Duration
+	}
+	return total
+}
+
+// Clone returns a copy of the segment that shares nothing with it
+func (s *Segment) Clone() *Segment {
+	c := *s
+	if s.ByteRange != nil {
+		br := *s.ByteRange
+		c.ByteRange = &br
+	}
+	if s.Key != nil {
+		key := *s.Key
+		key.Attributes = slices.Clone(key.Attributes)
+		key.parsed = slices.Clone(key.parsed)
+		c.Key = &key
+	}
+	if s.Map != nil {
+		m := *s.Map
+		if s.Map.ByteRange != nil {
+			br := *s.Map.ByteRange
+			m.ByteRange = &br
+		}
+		m.Attributes = slices.Clone(m.Attributes)
+		m.parsed = slices.Clone(m.parsed)
+		c.Map = &m
+	}
+	c.Tags = append([]string(nil), s.Tags...)
+	c.order = slices.Clone(s.order)
+	return &c
+}
@@ -0,0 +1,236 @@
+package m3u8
+
+import (
+	"strings"
+	"testing"
+)
+
+// playlist joins lines into a playlist as Encode writes it
+func playlist(lines ...string) string {
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"media", playlist(
+			"#EXTM3U",
+			"#EXT-X-TARGETDURATION:10",
+			"#EXT-X-VERSION:3",
+			"#EXT-X-MEDIA-SEQUENCE:0",
+			"#EXT-X-PLAYLIST-TYPE:VOD",
+			"#EXT-X-START:TIME-OFFSET=5.0",
+			"#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00.000Z",
+			"#EXTINF:10.000,first",
+			"seg0.ts",
+			"#EXTINF:9.5,",
+			"seg1.ts",
+			"#EXT-X-CUE-OUT:30",
+			"#EXT-X-DISCONTINUITY",
+			"#EXTINF:4,",
+			"ad0.ts",
+			"#EXT-X-CUE-IN",
+			"#EXT-X-ENDLIST",
+		)},
+		{"master", playlist(
+			"#EXTM3U",
+			"#EXT-X-INDEPENDENT-SEGMENTS",
+			"#EXT-X-CUSTOM-HEADER:1",
+			`#EXT-X-MEDIA:GROUP-ID="aud",TYPE=AUDIO,NAME="English",DEFAULT=NO,LANGUAGE="en",CHANNELS="2",URI="audio/en.m3u8"`,
+			`#EXT-X-STREAM-INF:HDCP-LEVEL=NONE,BANDWIDTH=1280000,RESOLUTION=1280x720,FRAME-RATE=29.970,CODECS="avc1.4d401f,mp4a.40.2",AUDIO="aud",CLOSED-CAPTIONS=NONE`,
+			"720p.m3u8",
+			`#EXT-X-SESSION-DATA:DATA-ID="com.example.title",VALUE="Lecture"`,
+			`#EXT-X-STREAM-INF:BANDWIDTH=640000,FRAME-RATE=30,AUDIO="aud"`,
+			"360p.m3u8",
+			`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",AUTOSELECT=YES,URI="subs/en.m3u8"`,
+			`#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=86000,URI="iframe.m3u8",CODECS="avc1.4d401f"`,
+			"#EXT-X-CUSTOM-TRAILER",
+		)},
+		{"byte range", playlist(
+			"#EXTM3U",
+			"#EXT-X-VERSION:4",
+			"#EXT-X-TARGETDURATION:6",
+			"#EXTINF:6.006,",
+			"#EXT-X-BYTERANGE:1000@0",
+			"packed.ts",
+			"#EXT-X-BYTERANGE:800@1000",
+			"#EXTINF:5.005,",
+			"packed.ts",
+			"#EXT-X-ENDLIST",
+		)},
+		{"key and map", playlist(
+			"#EXTM3U",
+			"#EXT-X-VERSION:7",
+			"#EXT-X-TARGETDURATION:4",
+			`#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"`,
+			`#EXT-X-KEY:METHOD=AES-128,URI="https://keys.example/k1",IV=0x00000000000000000000000000000001,KEYFORMAT="identity"`,
+			"#EXTINF:4.000,",
+			"seg0.m4s",
+			`#EXT-X-KEY:URI="https://keys.example/k2",METHOD=SAMPLE-AES,KEYFORMATVERSIONS="1",X-VENDOR="a"`,
+			"#EXTINF:4.000,",
+			"seg1.m4s",
+			"#EXT-X-KEY:METHOD=NONE",
+			"#EXTINF:4.000,",
+			"seg2.m4s",
+			"#EXT-X-ENDLIST",
+		)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := Parse([]byte(tt.in))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if got := p.String(); got != tt.in {
+				t.Errorf("Encode(Parse(in)) =\n%s\nwant\n%s", got, tt.in)
+			}
+		})
+	}
+}
+
+func TestParseMaster(t *testing.T) {
+	p, err := Parse([]byte(playlist(
+		"#EXTM3U",
+		"#EXT-X-CUSTOM:1",
+		`#EXT-X-STREAM-INF:BANDWIDTH=1280000,FRAME-RATE=29.970,HDCP-LEVEL=TYPE-0`,
+		"720p.m3u8",
+		`#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=86000,URI="iframe.m3u8"`,
+	)))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if !p.Master {
+		t.Fatal("Master = false")
+	}
+	if len(p.Tags) != 1 || p.Tags[0] != "#EXT-X-CUSTOM:1" || len(p.Trailer) != 0 {
+		t.Errorf("Tags = %q, Trailer = %q", p.Tags, p.Trailer)
+	}
+	if len(p.Variants) != 2 {
+		t.Fatalf("got %d variants", len(p.Variants))
+	}
+	v := p.Variants[0]
+	if v.URI != "720p.m3u8" || v.Bandwidth != 1280000 || v.FrameRate != 29.97 {
+		t.Errorf("variant = %+v", v)
+	}
+	if hdcp, _ := v.Attributes.Get("HDCP-LEVEL"); hdcp != "TYPE-0" {
+		t.Errorf("HDCP-LEVEL = %q", hdcp)
+	}
+	if iframe := p.Variants[1]; !iframe.IFrame || iframe.URI != "iframe.m3u8" {
+		t.Errorf("I-frame variant = %+v", iframe)
+	}
+}
+
+func TestParseByteRangeOffsets(t *testing.T) {
+	p, err := Parse([]byte(playlist(
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:6",
+		"#EXTINF:6,",
+		"#EXT-X-BYTERANGE:1000@500",
+		"packed.ts",
+		"#EXTINF:6,",
+		"#EXT-X-BYTERANGE:800",
+		"packed.ts",
+		"#EXTINF:6,",
+		"#EXT-X-BYTERANGE:600",
+		"other.ts",
+	)))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := []ByteRange{{1000, 500}, {800, 1500}, {600, 0}}
+	for i, seg := range p.Segments {
+		if *seg.ByteRange != want[i] {
+			t.Errorf("segment %d: byte range = %v, want %v", i, seg.ByteRange, want[i])
+		}
+	}
+	// Offsets are written out, so dropping a segment keeps the others valid
+	if got := p.String(); !strings.Contains(got, "#EXT-X-BYTERANGE:800@1500\n") {
+		t.Errorf("missing resolved offset in\n%s", got)
+	}
+}
+
+func TestEncodeModified(t *testing.T) {
+	p, err := Parse([]byte(playlist(
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:10",
+		"#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00.000Z",
+		"#EXTINF:10.000,",
+		"#EXT-X-BYTERANGE:100@0",
+		"seg0.ts",
+	)))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	seg := p.Segments[0]
+	seg.URI = "/proxy/seg0.ts"
+	seg.Duration = 9.5
+	seg.ByteRange = nil
+	seg.Discontinuity = true
+	seg.Key = &Key{Method: "NONE"}
+	p.MediaSequence = 3
+	want := playlist(
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:10",
+		"#EXT-X-MEDIA-SEQUENCE:3",
+		"#EXT-X-DISCONTINUITY",
+		"#EXT-X-KEY:METHOD=NONE",
+		"#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00.000Z",
+		"#EXTINF:9.5,",
+		"/proxy/seg0.ts",
+	)
+	if got := p.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestEncodeBuilt(t *testing.T) {
+	p := &Playlist{
+		Version:        3,
+		TargetDuration: 4,
+		PlaylistType:   "VOD",
+		Segments: []*Segment{
+			{URI: "a.ts", Duration: 4, Key: &Key{Method: "AES-128", URI: "k"}},
+			{URI: "b.ts", Duration: 3.2, Discontinuity: true, Tags: []string{"#EXT-X-GAP"}},
+		},
+		EndList: true,
+	}
+	want := playlist(
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		"#EXT-X-TARGETDURATION:4",
+		"#EXT-X-PLAYLIST-TYPE:VOD",
+		`#EXT-X-KEY:METHOD=AES-128,URI="k"`,
+		"#EXTINF:4,",
+		"a.ts",
+		"#EXT-X-DISCONTINUITY",
+		"#EXT-X-GAP",
+		"#EXTINF:3.2,",
+		"b.ts",
+		"#EXT-X-ENDLIST",
+	)
+	if got := p.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"empty", ""},
+		{"no header", "#EXTINF:1,\na.ts\n"},
+		{"bad duration", "#EXTM3U\n#EXTINF:x,\na.ts\n"},
+		{"bad byte range", "#EXTM3U\n#EXT-X-BYTERANGE:a@b\na.ts\n"},
+		{"bad map byte range", "#EXTM3U\n#EXT-X-MAP:URI=\"i.mp4\",BYTERANGE=\"x\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse([]byte(tt.in)); err == nil {
+				t.Error("Parse succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package m3u8
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Playlist-level tags kept verbatim in Playlist.Tags
+var playlistTags = []string{
+	"#EXT-X-START",
+	"#EXT-X-ALLOW-CACHE",
+	"#EXT-X-DEFINE",
+	"#EXT-X-SERVER-CONTROL",
+	"#EXT-X-PART-INF",
+	"#EXT-X-SESSION-DATA",
+	"#EXT-X-SESSION-KEY",
+	"#EXT-X-CONTENT-STEERING",
+}
+
+// Parse reads a master or media playlist. Byte ranges without an offset
+// are resolved against the previous segment. Comments are dropped.
+func Parse(data []byte) (*Playlist, error) {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSpace(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("m3u8: %w", err)
+	}
+
+	// Known up front, so tags ahead of the first variant stay in place
+	p := &Playlist{Master: slices.ContainsFunc(lines, isMasterTag)}
+	var (
+		seg       *Segment // Tags seen since the last URI
+		variant   *Variant // EXT-X-STREAM-INF waiting for its URI
+		prev      *Segment // Last complete segment, for byte range offsets
+		hasOffset bool
+		header    bool
+	)
+	segment := func(name string) *Segment {
+		if seg == nil {
+			seg = &Segment{}
+		}
+		seg.order = append(seg.order, name)
+		return seg
+	}
+
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+		if !header {
+			if line != "#EXTM3U" {
+				return nil, ErrNotPlaylist
+			}
+			header = true
+			continue
+		}
+
+		name, value, _ := strings.Cut(line, ":")
+		if slices.Contains(headerTags, name) || isMasterTag(line) {
+			p.order = append(p.order, name)
+		}
+		var err error
+		switch {
+		case !strings.HasPrefix(line, "#"):
+			if variant != nil {
+				variant.URI = line
+				p.Variants = append(p.Variants, variant)
+				variant = nil
+				continue
+			}
+			s := seg
+			if s == nil {
+				s = &Segment{}
+			}
+			s.URI = line
+			if s.ByteRange != nil && !hasOffset {
+				if prev != nil && prev.ByteRange != nil && prev.URI == s.URI {
+					s.ByteRange.Offset = prev.ByteRange.Offset + prev.ByteRange.Length
+				}
+			}
+			p.Segments = append(p.Segments, s)
+			prev, seg, hasOffset = s, nil, false
+		case name == "#EXTM3U":
+			continue
+		case name == "#EXT-X-VERSION":
+			p.Version, err = strconv.Atoi(value)
+		case name == "#EXT-X-INDEPENDENT-SEGMENTS":
+			p.IndependentSegments = true
+		case name == "#EXT-X-TARGETDURATION":
+			var d float64
+			d, err = strconv.ParseFloat(value, 64)
+			p.TargetDuration = int(math.Ceil(d))
+		case name == "#EXT-X-MEDIA-SEQUENCE":
+			p.MediaSequence, err = strconv.ParseInt(value, 10, 64)
+		case name == "#EXT-X-DISCONTINUITY-SEQUENCE":
+			p.DiscontinuitySequence, err = strconv.ParseInt(value, 10, 64)
+		case name == "#EXT-X-PLAYLIST-TYPE":
+			p.PlaylistType = value
+		case name == "#EXT-X-I-FRAMES-ONLY":
+			p.IFramesOnly = true
+		case name == "#EXT-X-ENDLIST":
+			p.EndList = true
+		case name == "#EXT-X-STREAM-INF":
+			variant = parseVariant(ParseAttributes(value))
+		case name == "#EXT-X-I-FRAME-STREAM-INF":
+			attrs := ParseAttributes(value)
+			v := parseVariant(attrs)
+			v.IFrame = true
+			v.URI, _ = attrs.Get("URI")
+			v.Attributes = v.Attributes.without("URI")
+			p.Variants = append(p.Variants, v)
+		case name == "#EXT-X-MEDIA":
+			p.Renditions = append(p.Renditions, parseRendition(ParseAttributes(value)))
+		case name == "#EXTINF":
+			duration, title, _ := strings.Cut(value, ",")
+			s := segment(name)
+			s.Title = title
+			s.duration = strings.TrimSpace(duration)
+			s.Duration, err = strconv.ParseFloat(s.duration, 64)
+		case name == "#EXT-X-BYTERANGE":
+			s := segment(name)
+			s.ByteRange, hasOffset, err = parseByteRange(value)
+		case name == "#EXT-X-DISCONTINUITY":
+			segment(name).Discontinuity = true
+		case name == "#EXT-X-KEY":
+			segment(name).Key = parseKey(ParseAttributes(value))
+		case name == "#EXT-X-MAP":
+			var m *Map
+			m, err = parseMap(ParseAttributes(value))
+			segment(name).Map = m
+		case slices.Contains(playlistTags, name), p.Master && strings.HasPrefix(line, "#EXT"):
+			p.Tags = append(p.Tags, line)
+			p.order = append(p.order, "")
+		case strings.HasPrefix(line, "#EXT"):
+			s := segment("")
+			s.Tags = append(s.Tags, line)
+		default:
+			// Comment
+		}
+		if err != nil {
+			return nil, fmt.Errorf("m3u8: line %d: invalid %s: %w", i+1, name, err)
+		}
+	}
+	if !header {
+		return nil, ErrNotPlaylist
+	}
+
+	if seg != nil {
+		p.Trailer = seg.Tags
+	}
+	return p, nil
+}
+
+func isMasterTag(line string) bool {
+	name, _, _ := strings.Cut(line, ":")
+	return name == "#EXT-X-STREAM-INF" || name == "#EXT-X-I-FRAME-STREAM-INF" || name == "#EXT-X-MEDIA"
+}
+
+// ParseByteRange parses "length@offset" as written by ByteRange.String
+func ParseByteRange(s string) (*ByteRange, error) {
+	br, hasOffset, err := parseByteRange(s)
+	if err != nil {
+		return nil, err
+	}
+	if !hasOffset || br.Length <= 0 || br.Offset < 0 {
+		return nil, fmt.Errorf("m3u8: invalid byte range %q", s)
+	}
+	return br, nil
+}
+
+// parseByteRange parses "length[@offset]"
+func parseByteRange(s string) (*ByteRange, bool, error) {
+	length, offset, hasOffset := strings.Cut(strings.TrimSpace(s), "@")
+	br := &ByteRange{}
+	var err error
+	if br.Length, err = strconv.ParseInt(length, 10, 64); err != nil {
+		return nil, false, err
+	}
+	if hasOffset {
+		if br.Offset, err = strconv.ParseInt(offset, 10, 64); err != nil {
+			return nil, false, err
+		}
+	}
+	return br, hasOffset, nil
+}
+
+func parseKey(attrs Attributes) *Key {
+	key := &Key{}
+	key.Method, _ = attrs.Get("METHOD")
+	key.URI, _ = attrs.Get("URI")
+	key.IV, _ = attrs.Get("IV")
+	key.KeyFormat, _ = attrs.Get("KEYFORMAT")
+	key.KeyFormatVersions, _ = attrs.Get("KEYFORMATVERSIONS")
+	key.Attributes = attrs.without(keyAttributes...)
+	key.parsed = attrs
+	return key
+}
+
+func parseMap(attrs Attributes) (*Map, error) {
+	m := &Map{Attributes: attrs.without("URI", "BYTERANGE"), parsed: attrs}
+	m.URI, _ = attrs.Get("URI")
+	if byteRange, ok := attrs.Get("BYTERANGE"); ok {
+		var err error
+		if m.ByteRange, _, err = parseByteRange(byteRange); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func parseVariant(attrs Attributes) *Variant {
+	v := &Variant{}
+	if value, ok := attrs.Get("BANDWIDTH"); ok {
+		v.Bandwidth, _ = strconv.ParseInt(value, 10, 64)
+	}
+	if value, ok := attrs.Get("AVERAGE-BANDWIDTH"); ok {
+		v.AverageBandwidth, _ = strconv.ParseInt(value, 10, 64)
+	}
+	if value, ok := attrs.Get("FRAME-RATE"); ok {
+		v.FrameRate, _ = strconv.ParseFloat(value, 64)
+	}
+	v.Codecs, _ = attrs.Get("CODECS")
+	v.Resolution, _ = attrs.Get("RESOLUTION")
+	v.Audio, _ = attrs.Get("AUDIO")
+	v.Video, _ = attrs.Get("VIDEO")
+	v.Subtitles, _ = attrs.Get("SUBTITLES")
+	v.ClosedCaptions, _ = attrs.Get("CLOSED-CAPTIONS")
+	v.Attributes = attrs.without(variantAttributes...)
+	v.parsed = attrs
+	return v
+}
+
+func parseRendition(attrs Attributes) *Rendition {
+	r := &Rendition{}
+	r.Type, _ = attrs.Get("TYPE")
+	r.GroupID, _ = attrs.Get("GROUP-ID")
+	r.Name, _ = attrs.Get("NAME")
+	r.Language, _ = attrs.Get("LANGUAGE")
+	r.URI, _ = attrs.Get("URI")
+	if value, _ := attrs.Get("DEFAULT"); value == "YES" {
+		r.Default = true
+	}
+	if value, _ := attrs.Get("AUTOSELECT"); value == "YES" {
+		r.Autoselect = true
+	}
+	r.Attributes = attrs.without(renditionAttributes...)
+	r.parsed = attrs
+	return r
+}
@@ -0,0 +1,306 @@
+package m3u8
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Attributes written from the typed fields of keys, variants and renditions
+var (
+	keyAttributes = []string{
+		"METHOD", "URI", "IV", "KEYFORMAT", "KEYFORMATVERSIONS",
+	}
+	variantAttributes = []string{
+		"BANDWIDTH", "AVERAGE-BANDWIDTH", "CODECS", "RESOLUTION", "FRAME-RATE",
+		"AUDIO", "VIDEO", "SUBTITLES", "CLOSED-CAPTIONS",
+	}
+	renditionAttributes = []string{
+		"TYPE", "GROUP-ID", "NAME", "LANGUAGE", "URI", "DEFAULT", "AUTOSELECT",
+	}
+)
+
+// Tags written from the typed fields of playlists and segments, in the
+// order used for those that were not parsed
+var (
+	headerTags = []string{
+		"#EXT-X-VERSION", "#EXT-X-INDEPENDENT-SEGMENTS", "#EXT-X-TARGETDURATION",
+		"#EXT-X-MEDIA-SEQUENCE", "#EXT-X-DISCONTINUITY-SEQUENCE",
+		"#EXT-X-PLAYLIST-TYPE", "#EXT-X-I-FRAMES-ONLY",
+	}
+	segmentTags = []string{
+		"#EXT-X-DISCONTINUITY", "#EXT-X-KEY", "#EXT-X-MAP", "#EXTINF", "#EXT-X-BYTERANGE",
+	}
+)
+
+// Encode writes the playlist
+func (p *Playlist) Encode() []byte {
+	return []byte(p.String())
+}
+
+// String writes the playlist. Parsed tags keep their order. Tags set
+// since, and all tags of a playlist built in code, go where the order of
+// headerTags and segmentTags puts them.
+func (p *Playlist) String() string {
+	var w writer
+	w.line("#EXTM3U")
+
+	tags, renditions, variants := p.Tags, p.Renditions, p.Variants
+	for i, name := range p.order {
+		switch name {
+		case "":
+			if len(tags) > 0 {
+				w.line(tags[0])
+				tags = tags[1:]
+			}
+		case "#EXT-X-MEDIA":
+			if p.Master && len(renditions) > 0 {
+				w.rendition(renditions[0])
+				renditions = renditions[1:]
+			}
+		case "#EXT-X-STREAM-INF", "#EXT-X-I-FRAME-STREAM-INF":
+			if p.Master && len(variants) > 0 {
+				w.variant(variants[0])
+				variants = variants[1:]
+			}
+		default:
+			if slices.Index(p.order, name) == i {
+				w.optional(p.header(name, true))
+			}
+		}
+	}
+	for _, name := range headerTags[:2] {
+		if !slices.Contains(p.order, name) {
+			w.optional(p.header(name, false))
+		}
+	}
+	for _, tag := range tags {
+		w.line(tag)
+	}
+	for _, name := range headerTags[2:] {
+		if !slices.Contains(p.order, name) {
+			w.optional(p.header(name, false))
+		}
+	}
+
+	if p.Master {
+		for _, r := range renditions {
+			w.rendition(r)
+		}
+		for _, v := range variants {
+			w.variant(v)
+		}
+		for _, tag := range p.Trailer {
+			w.line(tag)
+		}
+		return w.String()
+	}
+
+	for _, seg := range p.Segments {
+		w.segment(seg)
+	}
+	for _, tag := range p.Trailer {
+		w.line(tag)
+	}
+	if p.EndList {
+		w.line("#EXT-X-ENDLIST")
+	}
+	return w.String()
+}
+
+// header returns the named playlist-level tag, or "" where the playlist
+// does not have it. Parsed sequence numbers are kept even when zero.
+func (p *Playlist) header(name string, parsed bool) string {
+	switch name {
+	case "#EXT-X-VERSION":
+		if p.Version > 0 {
+			return name + ":" + strconv.Itoa(p.Version)
+		}
+	case "#EXT-X-INDEPENDENT-SEGMENTS":
+		if p.IndependentSegments {
+			return name
+		}
+	}
+	if p.Master {
+		return ""
+	}
+	switch name {
+	case "#EXT-X-TARGETDURATION":
+		return name + ":" + strconv.Itoa(p.TargetDuration)
+	case "#EXT-X-MEDIA-SEQUENCE":
+		if parsed || p.MediaSequence != 0 {
+			return name + ":" + strconv.FormatInt(p.MediaSequence, 10)
+		}
+	case "#EXT-X-DISCONTINUITY-SEQUENCE":
+		if parsed || p.DiscontinuitySequence != 0 {
+			return name + ":" + strconv.FormatInt(p.DiscontinuitySequence, 10)
+		}
+	case "#EXT-X-PLAYLIST-TYPE":
+		if p.PlaylistType != "" {
+			return name + ":" + p.PlaylistType
+		}
+	case "#EXT-X-I-FRAMES-ONLY":
+		if p.IFramesOnly {
+			return name
+		}
+	}
+	return ""
+}
+
+// tag returns the named segment tag, or "" where the segment does not
+// have it
+func (s *Segment) tag(name string) string {
+	switch name {
+	case "#EXT-X-DISCONTINUITY":
+		if s.Discontinuity {
+			return name
+		}
+	case "#EXT-X-KEY":
+		if s.Key != nil {
+			return name + ":" + s.Key.attributes().String()
+		}
+	case "#EXT-X-MAP":
+		if s.Map != nil {
+			return name + ":" + s.Map.attributes().String()
+		}
+	case "#EXTINF":
+		return name + ":" + formatFloat(s.Duration, s.duration) + "," + s.Title
+	case "#EXT-X-BYTERANGE":
+		if s.ByteRange != nil {
+			return name + ":" + s.ByteRange.String()
+		}
+	}
+	return ""
+}
+
+// String writes the range as "length@offset"
+func (r *ByteRange) String() string {
+	return strconv.FormatInt(r.Length, 10) + "@" + strconv.FormatInt(r.Offset, 10)
+}
+
+func (k *Key) attributes() Attributes {
+	var w attributeWriter
+	w.plain("METHOD", k.Method)
+	w.quoted("URI", k.URI)
+	w.plain("IV", k.IV)
+	w.quoted("KEYFORMAT", k.KeyFormat)
+	w.quoted("KEYFORMATVERSIONS", k.KeyFormatVersions)
+	return append(w.attrs, k.Attributes...).inOrder(k.parsed)
+}
+
+func (m *Map) attributes() Attributes {
+	var w attributeWriter
+	w.quoted("URI", m.URI)
+	if m.ByteRange != nil {
+		w.quoted("BYTERANGE", m.ByteRange.String())
+	}
+	return append(w.attrs, m.Attributes...).inOrder(m.parsed)
+}
+
+func (v *Variant) attributes() Attributes {
+	var w attributeWriter
+	w.plain("BANDWIDTH", strconv.FormatInt(v.Bandwidth, 10))
+	if v.AverageBandwidth > 0 {
+		w.plain("AVERAGE-BANDWIDTH", strconv.FormatInt(v.AverageBandwidth, 10))
+	}
+	w.quoted("CODECS", v.Codecs)
+	w.plain("RESOLUTION", v.Resolution)
+	if v.FrameRate > 0 {
+		parsed, _ := v.parsed.Get("FRAME-RATE")
+		w.plain("FRAME-RATE", formatFloat(v.FrameRate, parsed))
+	}
+	w.quoted("AUDIO", v.Audio)
+	w.quoted("VIDEO", v.Video)
+	w.quoted("SUBTITLES", v.Subtitles)
+	if v.ClosedCaptions == "NONE" {
+		w.plain("CLOSED-CAPTIONS", v.ClosedCaptions)
+	} else {
+		w.quoted("CLOSED-CAPTIONS", v.ClosedCaptions)
+	}
+	if v.IFrame {
+		w.quoted("URI", v.URI)
+	}
+	return append(w.attrs, v.Attributes...).inOrder(v.parsed)
+}
+
+func (r *Rendition) attributes() Attributes {
+	var w attributeWriter
+	w.plain("TYPE", r.Type)
+	w.quoted("GROUP-ID", r.GroupID)
+	w.quoted("NAME", r.Name)
+	w.quoted("LANGUAGE", r.Language)
+	w.quoted("URI", r.URI)
+	w.flag("DEFAULT", r.Default, r.parsed)
+	w.flag("AUTOSELECT", r.Autoselect, r.parsed)
+	return append(w.attrs, r.Attributes...).inOrder(r.parsed)
+}
+
+// formatFloat keeps the parsed spelling of f, e.g. "29.970" or "10.000",
+// as long as it still reads as f
+func formatFloat(f float64, parsed string) string {
+	if v, err := strconv.ParseFloat(parsed, 64); err == nil && v == f {
+		return parsed
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// writer builds a playlist line by line
+type writer struct {
+	strings.Builder
+}
+
+func (w *writer) line(s string) {
+	w.WriteString(s)
+	w.WriteByte('\n')
+}
+
+// optional writes s unless it is empty
+func (w *writer) optional(s string) {
+	if s != "" {
+		w.line(s)
+	}
+}
+
+func (w *writer) rendition(r *Rendition) {
+	w.line("#EXT-X-MEDIA:" + r.attributes().String())
+}
+
+func (w *writer) variant(v *Variant) {
+	if v.IFrame {
+		w.line("#EXT-X-I-FRAME-STREAM-INF:" + v.attributes().String())
+		return
+	}
+	w.line("#EXT-X-STREAM-INF:" + v.attributes().String())
+	w.line(v.URI)
+}
+
+// segment writes the parsed tags of the segment in their order and its URI.
+// Tags set since parsing go ahead of them, or last for EXTINF and
+// EXT-X-BYTERANGE.
+func (w *writer) segment(seg *Segment) {
+	for _, name := range segmentTags[:3] {
+		if !slices.Contains(seg.order, name) {
+			w.optional(seg.tag(name))
+		}
+	}
+	tags := seg.Tags
+	for i, name := range seg.order {
+		if name != "" {
+			if slices.Index(seg.order, name) == i {
+				w.optional(seg.tag(name))
+			}
+		} else if len(tags) > 0 {
+			w.line(tags[0])
+			tags = tags[1:]
+		}
+	}
+	for _, tag := range tags {
+		w.line(tag)
+	}
+	for _, name := range segmentTags[3:] {
+		if !slices.Contains(seg.order, name) {
+			w.optional(seg.tag(name))
+		}
+	}
+	w.line(seg.URI)
+}
@@ -2,10 +2,14 @@ package mapping
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,11 +22,103 @@ const (
 	FirstAvailable Strategy = "first_available"
 )
 
+// Mapping describes the intranet targets for a domain. Each entry in IP/IPs
+// is a bare address ("10.0.0.1", "fd00::1") and may carry its own port and
+// scheme ("10.0.0.1:8080", "[fd00::1]:8443", "http://10.0.0.1:8080").
+// Scheme and Port apply to entries that don't specify their own.
 type Mapping struct {
-	Type     string   `json:"type"`     // "single" or "loadbalance"
-	IP       string   `json:"ip"`       // For single type
-	IPs      []string `json:"ips"`      // For loadbalance type
-	Strategy Strategy `json:"strategy"` // Load balancing strategy
+	Type     string   `json:"type"`             // "single" or "loadbalance"
+	IP       string   `json:"ip"`               // For single type
+	IPs      []string `json:"ips"`              // For loadbalance type
+	Strategy Strategy `json:"strategy"`         // Load balancing strategy
+	Scheme   string   `json:"scheme,omitempty"` // Optional target scheme ("http" or "https")
+	Port     int      `json:"port,omitempty"`   // Optional target port
+}
+
+// Target is a parsed mapping entry
+type Target struct {
+	Scheme string // Empty keeps the scheme of the original URL
+	IP     string // IP address without brackets
+	Port   string // Empty keeps the port of the original URL
+}
+
+// HostPort formats the target address for use as a URL host, bracketing
+// IPv6 literals. The fallback port is used when the target has none.
+func (t Target) HostPort(fallbackPort string) string {
+	port := t.Port
+	if port == "" {
+		port = fallbackPort
+	}
+	if port != "" {
+		return net.JoinHostPort(t.IP, port)
+	}
+	return HostHeader(t.IP)
+}
+
+// HostHeader brackets bare IPv6 literals so they are valid in a Host header
+// or URL authority. Other values are returned unchanged.
+func HostHeader(host string) string {
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") && net.ParseIP(host) != nil {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// ParseTarget parses a mapping entry, applying the mapping-level scheme and
+// port defaults
+func ParseTarget(entry string, m *Mapping) (Target, error) {
+	var t Target
+	host := strings.TrimSpace(entry)
+
+	if i := strings.Index(host, "://"); i >= 0 {
+		t.Scheme = strings.ToLower(host[:i])
+		host = strings.TrimSuffix(host[i+3:], "/")
+	}
+
+	switch {
+	case strings.HasPrefix(host, "["):
+		// Bracketed IPv6, with or without port
+		if strings.HasSuffix(host, "]") {
+			t.IP = host[1 : len(host)-1]
+		} else {
+			ip, port, err := net.SplitHostPort(host)
+			if err != nil {
+				return Target{}, fmt.Errorf("invalid target %q: %w", entry, err)
+			}
+			t.IP, t.Port = ip, port
+		}
+	case strings.Count(host, ":") == 1:
+		ip, port, err := net.SplitHostPort(host)
+		if err != nil {
+			return Target{}, fmt.Errorf("invalid target %q: %w", entry, err)
+		}
+		t.IP, t.Port = ip, port
+	default:
+		// IPv4 or unbracketed IPv6 without port
+		t.IP = host
+	}
+
+	if net.ParseIP(t.IP) == nil {
+		return Target{}, fmt.Errorf("invalid target %q: not an IP address", entry)
+	}
+
+	if t.Scheme == "" && m != nil {
+		t.Scheme = strings.ToLower(m.Scheme)
+	}
+	if t.Scheme != "" && t.Scheme != "http" && t.Scheme != "https" {
+		return Target{}, fmt.Errorf("invalid target %q: unsupported scheme %q", entry, t.Scheme)
+	}
+
+	if t.Port == "" && m != nil && m.Port != 0 {
+		t.Port = strconv.Itoa(m.Port)
+	}
+	if t.Port != "" {
+		if p, err := strconv.Atoi(t.Port); err != nil || p < 1 || p > 65535 {
+			return Target{}, fmt.Errorf("invalid target %q: bad port %q", entry, t.Port)
+		}
+	}
+
+	return t, nil
 }
 
 type failedIP struct {
@@ -65,6 +161,10 @@ func (m *IntranetMapper) Reload() error {
 		return err
 	}
 
+	if err := validateMappings(mappings); err != nil {
+		return err
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -81,31 +181,87 @@ func (m *IntranetMapper) Reload() error {
 
 // RewriteURL replaces the domain with mapped IP if available
 func (m *IntranetMapper) RewriteURL(rawURL string) string {
+	rewritten, _ := m.Resolve(rawURL)
+	return rewritten
+}
+
+// Resolve rewrites rawURL like RewriteURL and also returns the selected
+// mapping entry for use with MarkIPFailed ("" if the domain is not mapped)
+func (m *IntranetMapper) Resolve(rawURL string) (string, string) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL, ""
+	}
+
+	entry, mapping := m.getMapping(parsedURL.Hostname())
+	if entry == "" {
+		return rawURL, ""
+	}
+
+	return rewriteTo(parsedURL, entry, mapping), entry
+}
+
+// ResolveAlternate rewrites rawURL to an available mapping entry other
+// than exclude, for hedging a request to a second IP. It returns "" when
+// the domain has no other entry.
+func (m *IntranetMapper) ResolveAlternate(rawURL, exclude string) (string, string) {
 	parsedURL, err := url.Parse(rawURL)
 	if err != nil {
-		return rawURL
+		return "", ""
 	}
+	domain := parsedURL.Hostname()
 
-	ip := m.getMapping(parsedURL.Hostname())
-	if ip == "" {
-		return rawURL
+	m.mu.Lock()
+	mapping, ok := m.mappings[domain]
+	if !ok || mapping.Type == "single" || len(mapping.IPs) < 2 {
+		m.mu.Unlock()
+		return "", ""
 	}
 
-	parsedURL.Host = ip
-	if parsedURL.Port() != "" {
-		parsedURL.Host = ip + ":" + parsedURL.Port()
+	// Walk the available IPs starting after the round robin position
+	available := m.filterAvailableIPs(mapping.IPs, domain)
+	start := m.currentIndex[domain]
+	entry := ""
+	for i := range available {
+		candidate := available[(start+i)%len(available)]
+		if candidate != exclude {
+			entry = candidate
+			break
+		}
 	}
+	m.mu.Unlock()
 
-	return parsedURL.String()
+	if entry == "" {
+		return "", ""
+	}
+	return rewriteTo(parsedURL, entry, mapping), entry
 }
 
-// GetOriginalHost returns the original hostname for setting Host header
+// rewriteTo points parsedURL at a mapping entry
+func rewriteTo(parsedURL *url.URL, entry string, mapping *Mapping) string {
+	target, err := ParseTarget(entry, mapping)
+	if err != nil {
+		log.Printf("Ignoring invalid mapping target for %s: %v", parsedURL.Hostname(), err)
+		return parsedURL.String()
+	}
+
+	rewritten := *parsedURL
+	if target.Scheme != "" {
+		rewritten.Scheme = target.Scheme
+	}
+	rewritten.Host = target.HostPort(parsedURL.Port())
+
+	return rewritten.String()
+}
+
+// GetOriginalHost returns the original host (with port, IPv6 bracketed)
+// for setting the Host header
 func (m *IntranetMapper) GetOriginalHost(rawURL string) string {
 	parsedURL, err := url.Parse(rawURL)
 	if err != nil {
 		return ""
 	}
-	return parsedURL.Hostname()
+	return HostHeader(parsedURL.Host)
 }
 
 // GetMappings returns a copy of all mappings
@@ -134,21 +290,23 @@ func (m *IntranetMapper) MarkIPFailed(ip, domain string) {
 	log.Printf("Marked IP as failed: %s for domain: %s", ip, domain)
 }
 
-func (m *IntranetMapper) getMapping(domain string) string {
+// getMapping returns the selected target entry for a domain along with its
+// mapping, or "" if the domain is not mapped
+func (m *IntranetMapper) getMapping(domain string) (string, *Mapping) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	mapping, ok := m.mappings[domain]
 	if !ok {
-		return ""
+		return "", nil
 	}
 
 	if mapping.Type == "single" {
-		return mapping.IP
+		return mapping.IP, mapping
 	}
 
 	// loadbalance type
-	return m.getLoadBalancedIP(domain, mapping)
+	return m.getLoadBalancedIP(domain, mapping), mapping
 }
 
 func (m *IntranetMapper) getLoadBalancedIP(domain string, mapping *Mapping) string {
@@ -211,3 +369,21 @@ func (m *IntranetMapper) clearFailedIPs(domain string) {
 	}
 	log.Printf("Cleared failed IPs for domain: %s", domain)
 }
+
+func validateMappings(mappings map[string]*Mapping) error {
+	for domain, mapping := range mappings {
+		if mapping == nil {
+			return fmt.Errorf("mapping for %s is empty", domain)
+		}
+		entries := mapping.IPs
+		if mapping.Type == "single" {
+			entries = []string{mapping.IP}
+		}
+		for _, entry := range entries {
+			if _, err := ParseTarget(entry, mapping); err != nil {
+				return fmt.Errorf("mapping for %s: %w", domain, err)
+			}
+		}
+	}
+	return nil
+}
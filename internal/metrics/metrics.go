@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	value atomic.Uint64
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add adds n to the counter
+func (c *Counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+// CounterVec is a set of counters partitioned by label values
+type CounterVec struct {
+	name     string
+	help     string
+	labels   []string
+	mu       sync.RWMutex
+	counters map[string]*Counter // key: label values joined by \xff
+}
+
+// With returns the counter for the given label values, creating it on first use
+func (v *CounterVec) With(values ...string) *Counter {
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	c, ok := v.counters[key]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.counters[key]; !ok {
+		c = &Counter{}
+		v.counters[key] = c
+	}
+	return c
+}
+
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+var (
+	registryMu sync.Mutex
+	counters   []*CounterVec
+	gauges     []*gaugeFunc
+)
+
+// NewCounterVec registers a labeled counter
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{
+		name:     name,
+		help:     help,
+		labels:   labels,
+		counters: make(map[string]*Counter),
+	}
+	registryMu.Lock()
+	counters = append(counters, v)
+	registryMu.Unlock()
+	return v
+}
+
+// NewGaugeFunc registers a gauge whose value is read from fn at scrape time
+func NewGaugeFunc(name, help string, fn func() float64) {
+	registryMu.Lock()
+	gauges = append(gauges, &gaugeFunc{name: name, help: help, fn: fn})
+	registryMu.Unlock()
+}
+
+// Handler serves all registered metrics in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		write(w)
+	})
+}
+
+func write(w io.Writer) {
+	registryMu.Lock()
+	vecs := append([]*CounterVec(nil), counters...)
+	gfs := append([]*gaugeFunc(nil), gauges...)
+	registryMu.Unlock()
+
+	for _, v := range vecs {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name)
+
+		v.mu.RLock()
+		keys := make([]string, 0, len(v.counters))
+		for k := range v.counters {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s%s %d\n", v.name, formatLabels(v.labels, k), v.counters[k].value.Load())
+		}
+		v.mu.RUnlock()
+	}
+
+	for _, g := range gfs {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		value := g.fn()
+		if math.IsNaN(value) {
+			continue
+		}
+		fmt.Fprintf(w, "%s %g\n", g.name, value)
+	}
+}
+
+func formatLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, 0, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
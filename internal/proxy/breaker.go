@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/autoslides/video-proxy/internal/metrics"
+)
+
+// ErrCircuitOpen is returned without contacting the upstream while its
+// circuit breaker is open
+var ErrCircuitOpen = errors.New("upstream circuit breaker is open")
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// Transitions are counted per network path, not per upstream: external
+// hosts come from request URLs and would make the label set unbounded.
+// The admin API lists the individual breakers.
+var breakerTransitions = metrics.NewCounterVec(
+	"proxy_breaker_transitions_total",
+	"Circuit breaker state changes by network path and new state",
+	"mode", "state",
+)
+
+// BreakerConfig controls when breakers open and how they recover
+type BreakerConfig struct {
+	FailureThreshold int           // Consecutive failures that open the breaker (0 disables)
+	OpenTimeout      time.Duration // How long to fail fast before probing
+	HalfOpenProbes   int           // Concurrent probe requests allowed while half-open
+}
+
+// BreakerStatus is a snapshot of one breaker for the admin API
+type BreakerStatus struct {
+	Upstream            string       `json:"upstream"`
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"`
+}
+
+type breaker struct {
+	mode     string // "intranet" or "external", for metrics
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probes   int
+}
+
+// breakers tracks one circuit breaker per upstream host or intranet IP
+type breakers struct {
+	mu     sync.Mutex
+	config BreakerConfig
+	m      map[string]*breaker
+}
+
+func newBreakers(config BreakerConfig) *breakers {
+	return &breakers{
+		config: config,
+		m:      make(map[string]*breaker),
+	}
+}
+
+// allow reports whether a request to upstream may be sent. A half-open
+// breaker admits a limited number of probes.
+func (b *breakers) allow(upstream string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.config.FailureThreshold <= 0 {
+		return nil
+	}
+
+	br, ok := b.m[upstream]
+	if !ok {
+		return nil
+	}
+
+	switch br.state {
+	case BreakerOpen:
+		if time.Since(br.openedAt) < b.config.OpenTimeout {
+			return ErrCircuitOpen
+		}
+		b.transition(br, BreakerHalfOpen)
+		br.probes = 1
+		return nil
+	case BreakerHalfOpen:
+		if br.probes >= b.maxProbes() {
+			return ErrCircuitOpen
+		}
+		br.probes++
+		return nil
+	default:
+		return nil
+	}
+}
+
+// success closes the breaker for upstream
+func (b *breakers) success(upstream string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br, ok := b.m[upstream]
+	if !ok {
+		return
+	}
+	if br.state != BreakerClosed {
+		b.transition(br, BreakerClosed)
+	}
+	br.failures = 0
+	br.probes = 0
+}
+
+// release gives back a half-open probe slot for a request that ended
+// without telling us anything about the upstream (e.g. the viewer left)
+func (b *breakers) release(upstream string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if br, ok := b.m[upstream]; ok && br.state == BreakerHalfOpen && br.probes > 0 {
+		br.probes--
+	}
+}
+
+// failure records a failed request and reports whether the breaker opened
+func (b *breakers) failure(upstream string, isIntranet bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.config.FailureThreshold <= 0 {
+		return false
+	}
+
+	br, ok := b.m[upstream]
+	if !ok {
+		br = &breaker{mode: "external", state: BreakerClosed}
+		if isIntranet {
+			br.mode = "intranet"
+		}
+		b.m[upstream] = br
+	}
+	br.failures++
+
+	if br.state == BreakerHalfOpen || (br.state == BreakerClosed && br.failures >= b.config.FailureThreshold) {
+		br.openedAt = time.Now()
+		br.probes = 0
+		b.transition(br, BreakerOpen)
+		return true
+	}
+	return false
+}
+
+func (b *breakers) maxProbes() int {
+	if b.config.HalfOpenProbes < 1 {
+		return 1
+	}
+	return b.config.HalfOpenProbes
+}
+
+func (b *breakers) transition(br *breaker, state BreakerState) {
+	br.state = state
+	breakerTransitions.With(br.mode, string(state)).Inc()
+}
+
+func (b *breakers) snapshot() []BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	result := make([]BreakerStatus, 0, len(b.m))
+	for upstream, br := range b.m {
+		status := BreakerStatus{
+			Upstream:            upstream,
+			State:               br.state,
+			ConsecutiveFailures: br.failures,
+		}
+		if br.state != BreakerClosed {
+			openedAt := br.openedAt
+			status.OpenedAt = &openedAt
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Upstream < result[j].Upstream })
+	return result
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/autoslides/video-proxy/internal/metrics"
+)
+
+var ignoredRanges = metrics.NewCounterVec(
+	"proxy_ignored_ranges_total",
+	"Range requests the upstream answered with the whole resource",
+)
+
+// ignoredRangeCount throttles the log to powers of two, since every
+// segment of a packed file hits it
+var ignoredRangeCount atomic.Int64
+
+// ByteRange is part of an upstream resource, for playlists that pack
+// several segments into one file. The zero value is the whole resource.
+type ByteRange struct {
+	Offset int64
+	Length int64
+}
+
+// IsZero reports whether r selects the whole resource
+func (r ByteRange) IsZero() bool {
+	return r.Length <= 0
+}
+
+// header returns the Range request header value
+func (r ByteRange) header() string {
+	return fmt.Sprintf("bytes=%d-%d", r.Offset, r.Offset+r.Length-1)
+}
+
+// apply turns a response to a range request into a 200 response whose
+// body is just the range. A 206 must start at the requested offset; an
+// upstream that ignored the Range header and sent the whole resource is
+// cut down here instead.
+func (r ByteRange) apply(resp *http.Response) error {
+	if r.IsZero() {
+		return nil
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		start, end, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != r.Offset {
+			return fmt.Errorf("TS range response %q does not match %s", resp.Header.Get("Content-Range"), r.header())
+		}
+		resp.Body = limitBody(resp.Body, min(r.Length, end-start+1))
+		resp.ContentLength = min(r.Length, end-start+1)
+	} else {
+		// Reading up to the offset costs the whole file before each
+		// segment, so make an upstream that does this visible
+		ignoredRanges.With().Inc()
+		if n := ignoredRangeCount.Add(1); n&(n-1) == 0 && resp.Request != nil {
+			log.Printf("Upstream %s ignored Range; %d range requests answered with the whole file so far", resp.Request.URL.Host, n)
+		}
+		if _, err := io.CopyN(io.Discard, resp.Body, r.Offset); err != nil {
+			return fmt.Errorf("TS shorter than range %s: %w", r.header(), err)
+		}
+		resp.Body = limitBody(resp.Body, r.Length)
+		// Without the upstream length the body may end before the range
+		// does, so its length stays unknown
+		if resp.ContentLength >= 0 {
+			resp.ContentLength = min(r.Length, resp.ContentLength-r.Offset)
+		}
+	}
+
+	resp.StatusCode = http.StatusOK
+	resp.Status = "200 OK"
+	resp.Header.Del("Content-Range")
+	resp.Header.Del("Accept-Ranges")
+	if resp.ContentLength >= 0 {
+		resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	} else {
+		resp.Header.Del("Content-Length")
+	}
+	return nil
+}
+
+// parseContentRange parses "bytes start-end/size"
+func parseContentRange(value string) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(value, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	spec, _, _ = strings.Cut(spec, "/")
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	end, err = strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// limitBody reads at most n bytes of body and still closes it
+func limitBody(body io.ReadCloser, n int64) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(body, n), body}
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestByteRangeApply(t *testing.T) {
+	file := make([]byte, 1000)
+	for i := range file {
+		file[i] = byte(i)
+	}
+	rng := ByteRange{Offset: 100, Length: 100}
+
+	tests := []struct {
+		name          string
+		rng           ByteRange
+		status        int
+		contentRange  string
+		body          []byte
+		contentLength int64 // -1 when unknown
+		want          []byte
+		unknownLength bool // Result has no Content-Length
+		wantErr       bool
+		ignored       bool
+	}{
+		{name: "206", rng: rng, status: 206, contentRange: "bytes 100-199/1000", body: file[100:200], contentLength: 100, want: file[100:200]},
+		{name: "206 longer than asked", rng: rng, status: 206, contentRange: "bytes 100-499/1000", body: file[100:500], contentLength: 400, want: file[100:200]},
+		{name: "206 at end of file", rng: rng, status: 206, contentRange: "bytes 100-149/150", body: file[100:150], contentLength: 50, want: file[100:150]},
+		{name: "206 wrong start", rng: rng, status: 206, contentRange: "bytes 0-99/1000", body: file[:100], contentLength: 100, wantErr: true},
+		{name: "206 bad content range", rng: rng, status: 206, contentRange: "bytes */1000", body: file[100:200], contentLength: 100, wantErr: true},
+		{name: "200", rng: rng, status: 200, body: file, contentLength: 1000, want: file[100:200], ignored: true},
+		{name: "200 unknown length", rng: rng, status: 200, body: file, contentLength: -1, want: file[100:200], unknownLength: true, ignored: true},
+		{name: "chunked 200 short body", rng: rng, status: 200, body: file[:150], contentLength: -1, want: file[100:150], unknownLength: true, ignored: true},
+		{name: "200 short body", rng: rng, status: 200, body: file[:150], contentLength: 150, want: file[100:150], ignored: true},
+		{name: "200 shorter than offset", rng: rng, status: 200, body: file[:50], contentLength: 50, wantErr: true, ignored: true},
+		{name: "whole resource", status: 200, body: file, contentLength: 1000, want: file},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode:    tt.status,
+				Status:        strconv.Itoa(tt.status) + " " + http.StatusText(tt.status),
+				Header:        http.Header{"Accept-Ranges": {"bytes"}},
+				Body:          io.NopCloser(bytes.NewReader(tt.body)),
+				ContentLength: tt.contentLength,
+				Request:       &http.Request{URL: &url.URL{Scheme: "http", Host: "upstream.example", Path: "/packed.ts"}},
+			}
+			if tt.contentRange != "" {
+				resp.Header.Set("Content-Range", tt.contentRange)
+			}
+
+			before := ignoredRangeCount.Load()
+			err := tt.rng.apply(resp)
+			if ignored := ignoredRangeCount.Load() > before; ignored != tt.ignored {
+				t.Errorf("counted as ignored = %v, want %v", ignored, tt.ignored)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("apply succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+
+			got, _ := io.ReadAll(resp.Body)
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("body = % x, want % x", got[:min(len(got), 8)], tt.want[:min(len(tt.want), 8)])
+			}
+			if tt.rng.IsZero() {
+				return
+			}
+			wantLength, wantHeader := int64(len(tt.want)), strconv.Itoa(len(tt.want))
+			if tt.unknownLength {
+				wantLength, wantHeader = -1, ""
+			}
+			if resp.StatusCode != http.StatusOK || resp.ContentLength != wantLength {
+				t.Errorf("status %d, length %d", resp.StatusCode, resp.ContentLength)
+			}
+			if resp.Header.Get("Content-Length") != wantHeader || resp.Header.Get("Content-Range") != "" || resp.Header.Get("Accept-Ranges") != "" {
+				t.Errorf("headers = %v", resp.Header)
+			}
+		})
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		value      string
+		start, end int64
+		ok         bool
+	}{
+		{"bytes 0-99/1000", 0, 99, true},
+		{"bytes 100-199/*", 100, 199, true},
+		{"bytes 100-199", 100, 199, true},
+		{"bytes 200-100/1000", 0, 0, false},
+		{"bytes */1000", 0, 0, false},
+		{"items 0-99/1000", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, end, ok := parseContentRange(tt.value)
+		if start != tt.start || end != tt.end || ok != tt.ok {
+			t.Errorf("parseContentRange(%q) = %d, %d, %v", tt.value, start, end, ok)
+		}
+	}
+}
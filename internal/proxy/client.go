@@ -1,17 +1,26 @@
 package proxy
 
 import (
-	"crypto/tls"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/autoslides/video-proxy/internal/mapping"
+	"github.com/autoslides/video-proxy/internal/metrics"
 )
 
-const (
-	maxRetries = 3
+var upstreamRequests = metrics.NewCounterVec(
+	"proxy_upstream_requests_total",
+	"Upstream requests by kind, network mode and result",
+	"kind", "mode", "result",
 )
 
 var baseHeaders = map[string]string{
@@ -20,234 +29,390 @@ var baseHeaders = map[string]string{
 	"User-Agent": "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/140.0.0.0 Safari/537.3",
 }
 
-type Client struct {
-	externalClient *http.Client
-	intranetClient *http.Client
-	mapper         *mapping.IntranetMapper
+// StatusError reports an upstream response with an unexpected status
+type StatusError struct {
+	Kind       string // "M3U8" or "TS"
+	StatusCode int
 }
 
-func NewClient(externalTimeout, intranetTimeout time.Duration, mapper *mapping.IntranetMapper) *Client {
-	return &Client{
-		externalClient: &http.Client{
-			Timeout: externalTimeout,
-		},
-		intranetClient: &http.Client{
-			Timeout: intranetTimeout,
-			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true, // Required for intranet IPs
-				},
-			},
-		},
-		mapper: mapper,
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s request failed with status %d", e.Kind, e.StatusCode)
+}
+
+// IsUnreachable reports whether err means the upstream could not be
+// reached: a connection failure, a timeout or an open circuit breaker.
+// Error statuses and failures outside the request, such as refreshing a
+// token or parsing the response, do not count.
+func IsUnreachable(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrIdleTimeout) {
+		return true
 	}
+	var opErr *net.OpError
+	var netErr net.Error
+	return errors.As(err, &opErr) || (errors.As(err, &netErr) && netErr.Timeout())
 }
 
-// FetchM3U8 fetches M3U8 content from the given URL
-func (c *Client) FetchM3U8(url string, isIntranet bool, originalHost string) ([]byte, error) {
-	client := c.externalClient
-	requestURL := url
+type fallbackKey struct{}
 
-	if isIntranet && c.mapper != nil {
-		client = c.intranetClient
-		requestURL = c.mapper.RewriteURL(url)
-	}
+// WithFallback marks requests made with ctx as having another network
+// path to fall back to. An unreachable upstream then fails the request
+// after the first attempt instead of being retried on this path.
+func WithFallback(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fallbackKey{}, true)
+}
 
-	req, err := http.NewRequest("GET", requestURL, nil)
-	if err != nil {
-		return nil, err
-	}
+func hasFallback(ctx context.Context) bool {
+	fallback, _ := ctx.Value(fallbackKey{}).(bool)
+	return fallback
+}
 
-	c.setHeaders(req, originalHost, isIntranet)
+type Client struct {
+	externalClient      *http.Client
+	intranetClient      *http.Client
+	externalIdleTimeout time.Duration
+	intranetIdleTimeout time.Duration
+	externalRetry       RetryPolicy
+	intranetRetry       RetryPolicy
+	breakers            *breakers
+	hedgeDelay          time.Duration // 0 disables hedging
+	mapper              *mapping.IntranetMapper
+}
 
-	resp, err := client.Do(req)
+// NewClient creates a proxy client. The transports are shared so that
+// repeated segment requests reuse pooled connections to each upstream.
+// Time to first byte is bounded by the transports' ResponseHeaderTimeout;
+// the idle timeouts abort bodies that stop making progress.
+func NewClient(
+	externalIdleTimeout, intranetIdleTimeout time.Duration,
+	externalTransport, intranetTransport http.RoundTripper,
+	mapper *mapping.IntranetMapper,
+) *Client {
+	return &Client{
+		externalClient:      &http.Client{Transport: externalTransport},
+		intranetClient:      &http.Client{Transport: intranetTransport},
+		externalIdleTimeout: externalIdleTimeout,
+		intranetIdleTimeout: intranetIdleTimeout,
+		externalRetry:       DefaultRetryPolicy(),
+		intranetRetry:       DefaultRetryPolicy(),
+		breakers:            newBreakers(BreakerConfig{}),
+		mapper:              mapper,
+	}
+}
+
+// FetchM3U8 fetches M3U8 content from the given URL
+func (c *Client) FetchM3U8(ctx context.Context, url string, isIntranet bool, originalHost string) ([]byte, error) {
+	resp, err := c.send(ctx, url, ByteRange{}, isIntranet, originalHost)
+	recordUpstream("m3u8", isIntranet, resp, err)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("M3U8 request failed with status %d", resp.StatusCode)
+		return nil, &StatusError{Kind: "M3U8", StatusCode: resp.StatusCode}
 	}
 
 	return io.ReadAll(resp.Body)
 }
 
 // ProxyTS streams TS content directly to the response writer
-func (c *Client) ProxyTS(url string, w http.ResponseWriter, isIntranet bool, originalHost string) error {
-	client := c.externalClient
-	requestURL := url
+func (c *Client) ProxyTS(ctx context.Context, url string, w http.ResponseWriter, isIntranet bool, originalHost string) error {
+	resp, err := c.send(ctx, url, ByteRange{}, isIntranet, originalHost)
+	recordUpstream("ts", isIntranet, resp, err)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
-	if isIntranet && c.mapper != nil {
-		client = c.intranetClient
-		requestURL = c.mapper.RewriteURL(url)
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Kind: "TS", StatusCode: resp.StatusCode}
 	}
 
-	req, err := http.NewRequest("GET", requestURL, nil)
+	return copyResponse(w, resp)
+}
+
+// FetchM3U8WithRetry fetches M3U8 following the retry policy of the
+// network mode. onRetry is called on 403 to allow token refresh. Retries
+// stop as soon as ctx is done.
+func (c *Client) FetchM3U8WithRetry(
+	ctx context.Context,
+	getURL func() string,
+	isIntranet bool,
+	originalHost string,
+	onRetry func(attempt int) error,
+) ([]byte, error) {
+	resp, err := c.doWithRetry(ctx, "m3u8", getURL, ByteRange{}, isIntranet, originalHost, onRetry)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	c.setHeaders(req, originalHost, isIntranet)
+	return io.ReadAll(resp.Body)
+}
 
-	resp, err := client.Do(req)
+// ProxyTSWithRetry streams TS following the retry policy of the network
+// mode. A non-zero rng streams only that part of the resource, as a
+// complete 200 response.
+func (c *Client) ProxyTSWithRetry(
+	ctx context.Context,
+	getURL func() string,
+	rng ByteRange,
+	w http.ResponseWriter,
+	isIntranet bool,
+	originalHost string,
+	onRetry func(attempt int) error,
+) error {
+	resp, err := c.doWithRetry(ctx, "ts", getURL, rng, isIntranet, originalHost, onRetry)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("TS request failed with status %d", resp.StatusCode)
+	return copyResponse(w, resp)
+}
+
+// FetchTSWithRetry downloads a whole segment into memory, following the
+// retry policy of the network mode. It returns the body and the upstream
+// response headers. A non-zero rng downloads only that part of the
+// resource.
+func (c *Client) FetchTSWithRetry(
+	ctx context.Context,
+	getURL func() string,
+	rng ByteRange,
+	isIntranet bool,
+	originalHost string,
+	onRetry func(attempt int) error,
+) ([]byte, http.Header, error) {
+	resp, err := c.doWithRetry(ctx, "ts", getURL, rng, isIntranet, originalHost, onRetry)
+	if err != nil {
+		return nil, nil, err
 	}
+	defer resp.Body.Close()
 
-	// Copy response headers
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
 	}
+	return body, resp.Header, nil
+}
 
-	w.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(w, resp.Body)
-	return err
+// SetRetryPolicies overrides the retry policy per network mode
+func (c *Client) SetRetryPolicies(external, intranet RetryPolicy) {
+	c.externalRetry = external
+	c.intranetRetry = intranet
 }
 
-// FetchM3U8WithRetry fetches M3U8 with retry logic for 403 errors
-// The retryFunc is called on 403 to allow token refresh
-func (c *Client) FetchM3U8WithRetry(
+// doWithRetry sends the request until it gets a 200 response, a
+// non-retryable status, or the policy's attempts are used up. With a
+// non-zero rng a 206 response also succeeds, and either is returned as a
+// 200 response carrying just the range. The caller must close the
+// returned body.
+func (c *Client) doWithRetry(
+	ctx context.Context,
+	kind string,
 	getURL func() string,
+	rng ByteRange,
 	isIntranet bool,
 	originalHost string,
 	onRetry func(attempt int) error,
-) ([]byte, error) {
-	var lastErr error
-
-	for attempt := 0; attempt <= maxRetries; attempt++ {
-		url := getURL()
+) (*http.Response, error) {
+	policy := c.externalRetry
+	if isIntranet {
+		policy = c.intranetRetry
+	}
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	label := strings.ToUpper(kind)
 
-		client := c.externalClient
-		requestURL := url
+	var lastErr error
 
-		if isIntranet && c.mapper != nil {
-			client = c.intranetClient
-			requestURL = c.mapper.RewriteURL(url)
-		}
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		lastAttempt := attempt == maxAttempts-1
 
-		req, err := http.NewRequest("GET", requestURL, nil)
+		resp, err := c.send(ctx, getURL(), rng, isIntranet, originalHost)
+		recordUpstream(kind, isIntranet, resp, err)
 		if err != nil {
-			return nil, err
+			// An open breaker on an external host won't close during our
+			// retries; intranet retries may pick another IP instead. With
+			// another path to try, the caller falls back right away.
+			if ctx.Err() != nil || (errors.Is(err, ErrCircuitOpen) && !isIntranet) || (hasFallback(ctx) && IsUnreachable(err)) {
+				return nil, err
+			}
+			lastErr = err
+			if lastAttempt {
+				break
+			}
+			if onRetry != nil {
+				onRetry(attempt)
+			}
+			if err := sleepContext(ctx, policy.delay(attempt, nil)); err != nil {
+				return nil, err
+			}
+			continue
 		}
 
-		c.setHeaders(req, originalHost, isIntranet)
-
-		resp, err := client.Do(req)
-		if err != nil {
-			lastErr = err
-			if attempt < maxRetries {
-				if onRetry != nil {
-					onRetry(attempt)
-				}
-				time.Sleep(time.Duration(attempt+1) * time.Second)
-				continue
+		if resp.StatusCode == http.StatusOK || (resp.StatusCode == http.StatusPartialContent && !rng.IsZero()) {
+			if err := rng.apply(resp); err != nil {
+				resp.Body.Close()
+				return nil, err
 			}
-			return nil, err
+			return resp, nil
 		}
 
-		body, err := io.ReadAll(resp.Body)
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
 		resp.Body.Close()
 
-		if resp.StatusCode == http.StatusOK {
-			return body, nil
+		lastErr = &StatusError{Kind: label, StatusCode: resp.StatusCode}
+		if !policy.retryable(resp.StatusCode) {
+			return nil, lastErr
 		}
 
-		if resp.StatusCode == http.StatusForbidden && attempt < maxRetries {
-			lastErr = fmt.Errorf("M3U8 request got 403")
-			if onRetry != nil {
-				if err := onRetry(attempt); err != nil {
-					return nil, err
-				}
+		if lastAttempt {
+			break
+		}
+		if resp.StatusCode == http.StatusForbidden && onRetry != nil {
+			if err := onRetry(attempt); err != nil {
+				return nil, err
 			}
-			time.Sleep(time.Duration(attempt+1) * time.Second)
-			continue
 		}
+		if err := sleepContext(ctx, policy.delay(attempt, resp)); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("%s request failed after %d attempts: %w", label, maxAttempts, lastErr)
+}
 
-		return nil, fmt.Errorf("M3U8 request failed with status %d", resp.StatusCode)
+// send performs a single upstream GET, rewriting the URL to a mapped IP in
+// intranet mode. The request is cancelled with ctx, and the response body
+// is guarded by the mode's idle timeout and must be closed by the caller.
+// Requests to an upstream whose circuit breaker is open fail fast with
+// ErrCircuitOpen. With hedging enabled, slow intranet requests are raced
+// against a second IP of the same mapping.
+func (c *Client) send(ctx context.Context, rawURL string, rng ByteRange, isIntranet bool, originalHost string) (*http.Response, error) {
+	if !isIntranet || c.mapper == nil {
+		return c.sendTo(ctx, rawURL, rawURL, "", rng, false, originalHost)
 	}
 
-	return nil, fmt.Errorf("M3U8 request failed after %d retries: %w", maxRetries, lastErr)
+	requestURL, entry := c.mapper.Resolve(rawURL)
+	if c.hedgeDelay > 0 && entry != "" {
+		return c.sendHedged(ctx, rawURL, requestURL, entry, rng, originalHost)
+	}
+	return c.sendTo(ctx, rawURL, requestURL, entry, rng, true, originalHost)
 }
 
-// ProxyTSWithRetry streams TS with retry logic for 403 errors
-func (c *Client) ProxyTSWithRetry(
-	getURL func() string,
-	w http.ResponseWriter,
-	isIntranet bool,
-	originalHost string,
-	onRetry func(attempt int) error,
-) error {
-	var lastErr error
+// sendTo sends the request to an already resolved URL. entry is the
+// mapping entry requestURL points at, if any.
+func (c *Client) sendTo(ctx context.Context, rawURL, requestURL, entry string, rng ByteRange, isIntranet bool, originalHost string) (*http.Response, error) {
+	client := c.externalClient
+	idleTimeout := c.externalIdleTimeout
+	if isIntranet {
+		client = c.intranetClient
+		idleTimeout = c.intranetIdleTimeout
+	}
 
-	for attempt := 0; attempt <= maxRetries; attempt++ {
-		url := getURL()
+	upstream := upstreamKey(requestURL)
+	if err := c.breakers.allow(upstream); err != nil {
+		return nil, fmt.Errorf("%s: %w", upstream, err)
+	}
 
-		client := c.externalClient
-		requestURL := url
+	reqCtx, cancel := context.WithCancel(ctx)
 
-		if isIntranet && c.mapper != nil {
-			client = c.intranetClient
-			requestURL = c.mapper.RewriteURL(url)
-		}
+	req, err := http.NewRequestWithContext(reqCtx, "GET", requestURL, nil)
+	if err != nil {
+		cancel()
+		c.breakers.release(upstream)
+		return nil, err
+	}
 
-		req, err := http.NewRequest("GET", requestURL, nil)
-		if err != nil {
-			return err
+	c.setHeaders(req, originalHost, isIntranet)
+	if !rng.IsZero() {
+		req.Header.Set("Range", rng.header())
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		if ctx.Err() != nil {
+			// A viewer going away (or a lost hedge) says nothing about the upstream
+			c.breakers.release(upstream)
+		} else {
+			c.recordFailure(upstream, rawURL, entry, isIntranet)
 		}
+		return nil, err
+	}
 
-		c.setHeaders(req, originalHost, isIntranet)
+	if resp.StatusCode >= 500 {
+		c.recordFailure(upstream, rawURL, entry, isIntranet)
+	} else {
+		c.breakers.success(upstream)
+	}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			lastErr = err
-			if attempt < maxRetries {
-				if onRetry != nil {
-					onRetry(attempt)
-				}
-				time.Sleep(time.Duration(attempt+1) * time.Second)
-				continue
-			}
-			return err
-		}
+	resp.Body = newIdleTimeoutBody(resp.Body, idleTimeout, cancel)
+	return resp, nil
+}
 
-		if resp.StatusCode == http.StatusOK {
-			// Copy response headers
-			for key, values := range resp.Header {
-				for _, value := range values {
-					w.Header().Add(key, value)
-				}
-			}
-			w.WriteHeader(resp.StatusCode)
-			_, err = io.Copy(w, resp.Body)
-			resp.Body.Close()
-			return err
-		}
+// SetBreakerConfig replaces the circuit breaker settings and resets all breakers
+func (c *Client) SetBreakerConfig(config BreakerConfig) {
+	c.breakers = newBreakers(config)
+}
 
-		resp.Body.Close()
+// BreakerStatus returns the state of every upstream breaker seen so far
+func (c *Client) BreakerStatus() []BreakerStatus {
+	return c.breakers.snapshot()
+}
 
-		if resp.StatusCode == http.StatusForbidden && attempt < maxRetries {
-			lastErr = fmt.Errorf("TS request got 403")
-			if onRetry != nil {
-				if err := onRetry(attempt); err != nil {
-					return err
-				}
-			}
-			time.Sleep(time.Duration(attempt+1) * time.Second)
-			continue
+// recordFailure counts a failure against the upstream's breaker. When the
+// breaker of an intranet IP opens, the IP is also taken out of load
+// balancing for its domain.
+func (c *Client) recordFailure(upstream, rawURL, entry string, isIntranet bool) {
+	if !c.breakers.failure(upstream, isIntranet) {
+		return
+	}
+	log.Printf("Circuit breaker opened for %s", upstream)
+
+	if entry != "" && c.mapper != nil {
+		if u, err := url.Parse(rawURL); err == nil {
+			c.mapper.MarkIPFailed(entry, u.Hostname())
 		}
+	}
+}
 
-		return fmt.Errorf("TS request failed with status %d", resp.StatusCode)
+// upstreamKey identifies the breaker for a request URL: the host for
+// external requests, the mapped IP and port for intranet requests
+func upstreamKey(requestURL string) string {
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return requestURL
 	}
+	return u.Host
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
 
-	return fmt.Errorf("TS request failed after %d retries: %w", maxRetries, lastErr)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// copyResponse copies upstream headers and streams the body to w
+func copyResponse(w http.ResponseWriter, resp *http.Response) error {
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err := io.Copy(w, resp.Body)
+	return err
 }
 
 func (c *Client) setHeaders(req *http.Request, originalHost string, isIntranet bool) {
@@ -256,7 +421,20 @@ func (c *Client) setHeaders(req *http.Request, originalHost string, isIntranet b
 	}
 
 	if isIntranet && originalHost != "" {
-		req.Host = originalHost
-		req.Header.Set("Host", originalHost)
+		host := mapping.HostHeader(originalHost)
+		req.Host = host
+		req.Header.Set("Host", host)
+	}
+}
+
+func recordUpstream(kind string, isIntranet bool, resp *http.Response, err error) {
+	mode := "external"
+	if isIntranet {
+		mode = "intranet"
+	}
+	result := "error"
+	if err == nil {
+		result = strconv.Itoa(resp.StatusCode)
 	}
+	upstreamRequests.With(kind, mode, result).Inc()
 }
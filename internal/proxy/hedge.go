@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/autoslides/video-proxy/internal/metrics"
+)
+
+var hedgedRequests = metrics.NewCounterVec(
+	"proxy_hedged_requests_total",
+	"Intranet requests raced against a second IP, by which request won",
+	"winner",
+)
+
+type hedgeResult struct {
+	index int
+	resp  *http.Response
+	err   error
+}
+
+// SetHedgeDelay enables hedging: if an intranet request has no response
+// headers after delay, a second request goes to another IP of the mapping
+// and the first usable response wins. Zero disables hedging.
+func (c *Client) SetHedgeDelay(delay time.Duration) {
+	c.hedgeDelay = delay
+}
+
+// sendHedged races the primary request against a hedge to another IP.
+// A response below 500 wins immediately; a failure fires the hedge early.
+// The losing request is cancelled.
+func (c *Client) sendHedged(ctx context.Context, rawURL, requestURL, entry string, rng ByteRange, originalHost string) (*http.Response, error) {
+	results := make(chan hedgeResult, 2)
+	cancels := make([]context.CancelFunc, 0, 2)
+
+	launch := func(requestURL, entry string) {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := c.sendTo(attemptCtx, rawURL, requestURL, entry, rng, true, originalHost)
+			results <- hedgeResult{index: index, resp: resp, err: err}
+		}()
+	}
+
+	// fireHedge starts the second request if the mapping has another IP
+	fireHedge := func() bool {
+		altURL, altEntry := c.mapper.ResolveAlternate(rawURL, entry)
+		if altURL == "" {
+			return false
+		}
+		launch(altURL, altEntry)
+		return true
+	}
+
+	launch(requestURL, entry)
+	pending := 1
+
+	timer := time.NewTimer(c.hedgeDelay)
+	defer timer.Stop()
+	hedgeC := timer.C
+
+	var fallback *hedgeResult
+	for pending > 0 {
+		select {
+		case <-hedgeC:
+			hedgeC = nil
+			if fireHedge() {
+				pending++
+			}
+
+		case res := <-results:
+			pending--
+
+			if res.err == nil && res.resp.StatusCode < 500 {
+				if len(cancels) > 1 {
+					hedgedRequests.With(hedgeWinner(res.index)).Inc()
+				}
+				c.abandonHedges(cancels, res.index, results, pending)
+				if fallback != nil && fallback.resp != nil {
+					fallback.resp.Body.Close()
+				}
+				res.resp.Body = &cancelOnClose{ReadCloser: res.resp.Body, cancel: cancels[res.index]}
+				return res.resp, nil
+			}
+
+			// Keep the latest failure in case nothing succeeds
+			if fallback != nil && fallback.resp != nil {
+				fallback.resp.Body.Close()
+			}
+			fallback = &res
+
+			// Don't wait for the delay once the primary has failed
+			if hedgeC != nil {
+				hedgeC = nil
+				if fireHedge() {
+					pending++
+				}
+			}
+		}
+	}
+
+	for i, cancel := range cancels {
+		if fallback.resp == nil || i != fallback.index {
+			cancel()
+		}
+	}
+	if fallback.resp != nil {
+		fallback.resp.Body = &cancelOnClose{ReadCloser: fallback.resp.Body, cancel: cancels[fallback.index]}
+	}
+	return fallback.resp, fallback.err
+}
+
+// abandonHedges cancels every request but the winner and closes any
+// responses that still arrive
+func (c *Client) abandonHedges(cancels []context.CancelFunc, winner int, results <-chan hedgeResult, pending int) {
+	for i, cancel := range cancels {
+		if i != winner {
+			cancel()
+		}
+	}
+	if pending == 0 {
+		return
+	}
+	go func() {
+		for ; pending > 0; pending-- {
+			if res := <-results; res.resp != nil {
+				res.resp.Body.Close()
+			}
+		}
+	}()
+}
+
+func hedgeWinner(index int) string {
+	if index == 0 {
+		return "primary"
+	}
+	return "hedge"
+}
+
+// cancelOnClose releases the attempt context once the body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how failed upstream requests are retried
+type RetryPolicy struct {
+	MaxAttempts     int           // Total attempts including the first
+	BaseDelay       time.Duration // Delay before the first retry, doubled each attempt
+	MaxDelay        time.Duration // Upper bound for a single delay
+	Jitter          float64       // Fraction of each delay that is randomized (0-1)
+	RetryableStatus []int         // Upstream status codes worth retrying
+	HonorRetryAfter bool          // Use the upstream Retry-After header when present
+}
+
+// DefaultRetryPolicy retries 403 (expired token) and gateway errors from
+// overloaded lecture servers
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:     4,
+		BaseDelay:       500 * time.Millisecond,
+		MaxDelay:        5 * time.Second,
+		Jitter:          0.5,
+		RetryableStatus: []int{403, 429, 502, 503, 504},
+		HonorRetryAfter: true,
+	}
+}
+
+func (p RetryPolicy) retryable(status int) bool {
+	for _, s := range p.RetryableStatus {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns the wait before the retry following attempt (0-based)
+func (p RetryPolicy) delay(attempt int, resp *http.Response) time.Duration {
+	if p.HonorRetryAfter && resp != nil {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			if p.MaxDelay > 0 && d > p.MaxDelay {
+				d = p.MaxDelay
+			}
+			return d
+		}
+	}
+
+	d := p.BaseDelay
+	for i := 0; i < attempt && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+
+	if p.Jitter > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		fixed := float64(d) * (1 - jitter)
+		d = time.Duration(fixed + rand.Float64()*float64(d)*jitter)
+	}
+	return d
+}
+
+// parseRetryAfter accepts delay-seconds or an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
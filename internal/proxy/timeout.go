@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIdleTimeout is returned when an upstream body stops sending data
+var ErrIdleTimeout = errors.New("upstream body idle timeout")
+
+// idleTimeoutBody cancels the request when a single read waits longer than
+// the timeout, so slow but progressing transfers complete while stalled
+// ones fail fast. Time spent outside Read (e.g. writing to a slow viewer)
+// does not count.
+type idleTimeoutBody struct {
+	body     io.ReadCloser
+	timeout  time.Duration
+	timer    *time.Timer
+	cancel   context.CancelFunc
+	timedOut atomic.Bool
+}
+
+// newIdleTimeoutBody wraps body; cancel aborts the underlying request.
+// A zero timeout disables the idle check.
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) io.ReadCloser {
+	b := &idleTimeoutBody{
+		body:    body,
+		timeout: timeout,
+		cancel:  cancel,
+	}
+	if timeout > 0 {
+		b.timer = time.AfterFunc(timeout, func() {
+			b.timedOut.Store(true)
+			cancel()
+		})
+		b.timer.Stop()
+	}
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	if b.timer == nil {
+		return b.body.Read(p)
+	}
+
+	b.timer.Reset(b.timeout)
+	n, err := b.body.Read(p)
+	b.timer.Stop()
+
+	if err != nil && b.timedOut.Load() {
+		return n, ErrIdleTimeout
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
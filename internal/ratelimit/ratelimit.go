@@ -0,0 +1,215 @@
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/autoslides/video-proxy/internal/metrics"
+)
+
+const (
+	// Buckets unused for this long are dropped
+	idleTTL = 10 * time.Minute
+)
+
+var limitedRequests = metrics.NewCounterVec(
+	"proxy_rate_limited_total",
+	"Requests rejected by the rate limiter by route",
+	"route",
+)
+
+// Bucket is a token bucket refilled at rate tokens per second up to burst
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes one token. If none is available it returns false and how
+// long until one will be.
+func (b *Bucket) Allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
+
+// Take removes n tokens, letting the balance go negative, and returns how
+// long the caller should wait before the debt is repaid
+func (b *Bucket) Take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *Bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+}
+
+// KeyFunc extracts the rate limiting key from a request
+type KeyFunc func(r *http.Request) string
+
+// ClientIP returns the remote IP of a request. With trustForwarded the
+// first address in X-Forwarded-For is used when present.
+func ClientIP(r *http.Request, trustForwarded bool) string {
+	if trustForwarded {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// NewKeyFunc builds a key function for "ip", "token" or "ip+token".
+// Requests without a login token are keyed by IP.
+func NewKeyFunc(by string, trustForwarded bool) KeyFunc {
+	return func(r *http.Request) string {
+		ip := ClientIP(r, trustForwarded)
+		token := r.URL.Query().Get("token")
+
+		switch by {
+		case "token":
+			if token != "" {
+				return "token:" + token
+			}
+			return "ip:" + ip
+		case "ip+token":
+			return "ip:" + ip + "|token:" + token
+		default:
+			return "ip:" + ip
+		}
+	}
+}
+
+type limiterEntry struct {
+	bucket   *Bucket
+	lastSeen time.Time
+}
+
+// Limiter applies a separate token bucket per key
+type Limiter struct {
+	route   string
+	rate    float64
+	burst   int
+	keyFunc KeyFunc
+
+	mu      sync.Mutex
+	buckets map[string]*limiterEntry
+}
+
+// NewLimiter creates a limiter for a route. A rate of zero or less
+// disables limiting and returns nil, which Middleware treats as a no-op.
+func NewLimiter(route string, rate float64, burst int, keyFunc KeyFunc) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	l := &Limiter{
+		route:   route,
+		rate:    rate,
+		burst:   burst,
+		keyFunc: keyFunc,
+		buckets: make(map[string]*limiterEntry),
+	}
+	go l.cleanup()
+	return l
+}
+
+// Allow reports whether a request for key may proceed
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+
+	l.mu.Lock()
+	entry, ok := l.buckets[key]
+	if !ok {
+		entry = &limiterEntry{bucket: NewBucket(l.rate, l.burst)}
+		l.buckets[key] = entry
+	}
+	entry.lastSeen = now
+	l.mu.Unlock()
+
+	return entry.bucket.Allow()
+}
+
+// Middleware rejects requests over the limit with 429 and Retry-After
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ok, wait := l.Allow(l.keyFunc(r))
+		if !ok {
+			limitedRequests.With(l.route).Inc()
+			seconds := int(math.Ceil(wait.Seconds()))
+			if seconds < 1 {
+				seconds = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *Limiter) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cutoff := time.Now().Add(-idleTTL)
+		l.mu.Lock()
+		for key, entry := range l.buckets {
+			if entry.lastSeen.Before(cutoff) {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Largest write passed through at once, so waits stay short and
+	// several viewers share a bucket fairly
+	maxChunk = 32 * 1024
+)
+
+// Bandwidth is a byte rate with burst. A zero rate means unlimited.
+type Bandwidth struct {
+	Rate  int64 // bytes per second
+	Burst int64 // bytes
+}
+
+// Throttle caps the bandwidth of response bodies per connection, per
+// login token and globally
+type Throttle struct {
+	perConn  Bandwidth
+	perToken Bandwidth
+	global   *Bucket
+
+	mu     sync.Mutex
+	tokens map[string]*limiterEntry
+}
+
+// NewThrottle returns nil when no cap is configured
+func NewThrottle(perConn, perToken, global Bandwidth) *Throttle {
+	if perConn.Rate <= 0 && perToken.Rate <= 0 && global.Rate <= 0 {
+		return nil
+	}
+
+	t := &Throttle{
+		perConn:  perConn,
+		perToken: perToken,
+		tokens:   make(map[string]*limiterEntry),
+	}
+	if global.Rate > 0 {
+		t.global = newByteBucket(global)
+	}
+	go t.cleanup()
+	return t
+}
+
+// Wrap returns a response writer whose body writes are throttled. A nil
+// throttle returns w unchanged.
+func (t *Throttle) Wrap(ctx context.Context, w http.ResponseWriter, loginToken string) http.ResponseWriter {
+	if t == nil {
+		return w
+	}
+
+	buckets := make([]*Bucket, 0, 3)
+	if t.perConn.Rate > 0 {
+		buckets = append(buckets, newByteBucket(t.perConn))
+	}
+	if t.perToken.Rate > 0 && loginToken != "" {
+		buckets = append(buckets, t.tokenBucket(loginToken))
+	}
+	if t.global != nil {
+		buckets = append(buckets, t.global)
+	}
+	if len(buckets) == 0 {
+		return w
+	}
+
+	return &throttledWriter{ResponseWriter: w, ctx: ctx, buckets: buckets}
+}
+
+func (t *Throttle) tokenBucket(loginToken string) *Bucket {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.tokens[loginToken]
+	if !ok {
+		entry = &limiterEntry{bucket: newByteBucket(t.perToken)}
+		t.tokens[loginToken] = entry
+	}
+	entry.lastSeen = time.Now()
+	return entry.bucket
+}
+
+func (t *Throttle) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cutoff := time.Now().Add(-idleTTL)
+		t.mu.Lock()
+		for key, entry := range t.tokens {
+			if entry.lastSeen.Before(cutoff) {
+				delete(t.tokens, key)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+func newByteBucket(bw Bandwidth) *Bucket {
+	burst := bw.Burst
+	if burst < maxChunk {
+		burst = maxChunk
+	}
+	return NewBucket(float64(bw.Rate), int(burst))
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	buckets []*Bucket
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxChunk {
+			n = maxChunk
+		}
+
+		var wait time.Duration
+		for _, b := range tw.buckets {
+			if d := b.Take(n); d > wait {
+				wait = d
+			}
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-tw.ctx.Done():
+				timer.Stop()
+				return written, tw.ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		m, err := tw.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,75 @@
+package remux
+
+import "errors"
+
+// Samples per AAC frame
+const aacFrameSamples = 1024
+
+var errBadADTS = errors.New("remux: malformed ADTS header")
+
+var aacSampleRates = []int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// aacConfig is the stream format carried in every ADTS header
+type aacConfig struct {
+	objectType int
+	rateIndex  int
+	channels   int
+}
+
+func (c aacConfig) sampleRate() int {
+	return aacSampleRates[c.rateIndex]
+}
+
+// audioSpecificConfig returns the MPEG-4 AudioSpecificConfig for esds
+func (c aacConfig) audioSpecificConfig() []byte {
+	return []byte{
+		byte(c.objectType<<3 | c.rateIndex>>1),
+		byte(c.rateIndex&1<<7 | c.channels<<3),
+	}
+}
+
+// adtsHeader returns a 7-byte ADTS header (no CRC) for a raw frame
+func (c aacConfig) adtsHeader(frameLen int) []byte {
+	n := frameLen + 7
+	return []byte{
+		0xff, 0xf1,
+		byte((c.objectType-1)<<6 | c.rateIndex<<2 | c.channels>>2),
+		byte(c.channels&0x3<<6 | n>>11),
+		byte(n >> 3),
+		byte(n&0x7<<5 | 0x1f),
+		0xfc,
+	}
+}
+
+// splitADTS splits an ADTS stream into raw AAC frames
+func splitADTS(data []byte) (frames [][]byte, config aacConfig, err error) {
+	for len(data) > 0 {
+		if len(data) < 7 || data[0] != 0xff || data[1]&0xf0 != 0xf0 {
+			return nil, aacConfig{}, errBadADTS
+		}
+
+		headerLen := 7
+		if data[1]&0x01 == 0 {
+			headerLen = 9 // CRC present
+		}
+		frameLen := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5])>>5
+		if frameLen < headerLen || frameLen > len(data) {
+			return nil, aacConfig{}, errBadADTS
+		}
+
+		config = aacConfig{
+			objectType: int(data[2]>>6) + 1,
+			rateIndex:  int(data[2] >> 2 & 0x0f),
+			channels:   int(data[2]&0x01)<<2 | int(data[3]>>6),
+		}
+		if config.rateIndex >= len(aacSampleRates) {
+			return nil, aacConfig{}, errBadADTS
+		}
+
+		frames = append(frames, data[headerLen:frameLen])
+		data = data[frameLen:]
+	}
+	return frames, config, nil
+}
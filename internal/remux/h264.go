@@ -0,0 +1,276 @@
+package remux
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// H.264 NAL unit types
+const (
+	nalIDR = 5
+	nalSPS = 7
+	nalPPS = 8
+	nalAUD = 9
+)
+
+var errBadSPS = errors.New("remux: malformed H.264 SPS")
+
+// splitNALUs splits an Annex B byte stream at its start codes
+func splitNALUs(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	zeros := 0
+
+	for i, b := range data {
+		switch {
+		case b == 0:
+			zeros++
+			continue
+		case b == 1 && zeros >= 2:
+			if start >= 0 {
+				end := i - zeros
+				if end > start {
+					nalus = append(nalus, data[start:end])
+				}
+			}
+			start = i + 1
+		}
+		zeros = 0
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+	return nalus
+}
+
+// accessUnit converts an Annex B access unit to length-prefixed NAL units
+// as stored in MP4. Parameter sets and delimiters are dropped from the
+// sample and returned separately.
+func accessUnit(data []byte) (sample []byte, sps, pps []byte, keyframe bool) {
+	for _, nalu := range splitNALUs(data) {
+		switch nalu[0] & 0x1f {
+		case nalSPS:
+			sps = nalu
+			continue
+		case nalPPS:
+			pps = nalu
+			continue
+		case nalAUD:
+			continue
+		case nalIDR:
+			keyframe = true
+		}
+		sample = binary.BigEndian.AppendUint32(sample, uint32(len(nalu)))
+		sample = append(sample, nalu...)
+	}
+	return sample, sps, pps, keyframe
+}
+
+// bitReader reads big-endian bits and Exp-Golomb codes. The first read
+// past the end fails every later read too, so callers may skip fields
+// without checking and test err once.
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+	err  error
+}
+
+func (r *bitReader) bit() (uint32, error) {
+	if r.err == nil && r.pos >= len(r.data)*8 {
+		r.err = errBadSPS
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	b := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+	return uint32(b), nil
+}
+
+func (r *bitReader) bits(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+func (r *bitReader) ue() (uint32, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			r.err = errBadSPS
+			return 0, r.err
+		}
+	}
+	v, err := r.bits(zeros)
+	return 1<<zeros - 1 + v, err
+}
+
+func (r *bitReader) se() (int32, error) {
+	v, err := r.ue()
+	if v%2 == 1 {
+		return int32(v/2 + 1), err
+	}
+	return -int32(v / 2), err
+}
+
+// unescapeRBSP removes emulation prevention bytes
+func unescapeRBSP(nalu []byte) []byte {
+	out := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// spsDimensions returns the cropped picture size declared by an SPS
+func spsDimensions(sps []byte) (width, height int, err error) {
+	r := &bitReader{data: unescapeRBSP(sps), pos: 8}
+
+	profile, _ := r.bits(8)
+	r.bits(16) // constraint flags and level
+	if _, err := r.ue(); err != nil {
+		return 0, 0, err
+	}
+
+	chromaFormat := uint32(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormat, err = r.ue(); err != nil {
+			return 0, 0, err
+		}
+		if chromaFormat == 3 {
+			r.bit() // separate_colour_plane_flag
+		}
+		r.ue()  // bit_depth_luma_minus8
+		r.ue()  // bit_depth_chroma_minus8
+		r.bit() // qpprime_y_zero_transform_bypass_flag
+		present, err := r.bit()
+		if err != nil {
+			return 0, 0, err
+		}
+		if present == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if flag, _ := r.bit(); flag == 1 {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					if err := skipScalingList(r, size); err != nil {
+						return 0, 0, err
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	pocType, err := r.ue()
+	if err != nil {
+		return 0, 0, err
+	}
+	switch pocType {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bit() // delta_pic_order_always_zero_flag
+		r.se()  // offset_for_non_ref_pic
+		r.se()  // offset_for_top_to_bottom_field
+		n, err := r.ue()
+		if err != nil || n > 255 {
+			return 0, 0, errBadSPS
+		}
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			r.se() // offset_for_ref_frame
+		}
+	}
+	r.ue()  // max_num_ref_frames
+	r.bit() // gaps_in_frame_num_value_allowed_flag
+
+	widthMBs, _ := r.ue()
+	heightUnits, _ := r.ue()
+	frameMBsOnly, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if frameMBsOnly == 0 {
+		r.bit() // mb_adaptive_frame_field_flag
+	}
+	r.bit() // direct_8x8_inference_flag
+
+	width = int(widthMBs+1) * 16
+	height = int(2-frameMBsOnly) * int(heightUnits+1) * 16
+
+	cropping, err := r.bit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if cropping == 1 {
+		left, _ := r.ue()
+		right, _ := r.ue()
+		top, _ := r.ue()
+		bottom, err := r.ue()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		cropX, cropY := 1, int(2-frameMBsOnly)
+		switch chromaFormat {
+		case 1:
+			cropX, cropY = 2, 2*int(2-frameMBsOnly)
+		case 2:
+			cropX = 2
+		}
+		width -= int(left+right) * cropX
+		height -= int(top+bottom) * cropY
+	}
+
+	if r.err != nil || width <= 0 || height <= 0 {
+		return 0, 0, errBadSPS
+	}
+	return width, height, nil
+}
+
+func skipScalingList(r *bitReader, size int) error {
+	last, next := int32(8), int32(8)
+	for j := 0; j < size; j++ {
+		if next != 0 {
+			delta, err := r.se()
+			if err != nil {
+				return err
+			}
+			next = (last + delta + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+	return nil
+}
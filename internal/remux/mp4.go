@@ -0,0 +1,213 @@
+package remux
+
+import "encoding/binary"
+
+// Sample flags for trun entries
+const (
+	flagsSync    = 0x02000000 // depends on no other sample
+	flagsNonSync = 0x01010000 // depends on others, not a sync sample
+)
+
+// unity transformation matrix shared by mvhd and tkhd
+var identityMatrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+// box encodes an ISO BMFF box with the given payloads
+func box(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+	out := make([]byte, 0, size)
+	out = binary.BigEndian.AppendUint32(out, uint32(size))
+	out = append(out, typ...)
+	for _, p := range payloads {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// fullBox encodes a box with a version and flags header
+func fullBox(typ string, version byte, flags uint32, payloads ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{header}, payloads...)...)
+}
+
+// fields appends big-endian integers; each value's type sets its width
+func fields(values ...any) []byte {
+	var out []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case uint8:
+			out = append(out, v)
+		case uint16:
+			out = binary.BigEndian.AppendUint16(out, v)
+		case uint32:
+			out = binary.BigEndian.AppendUint32(out, v)
+		case int32:
+			out = binary.BigEndian.AppendUint32(out, uint32(v))
+		case uint64:
+			out = binary.BigEndian.AppendUint64(out, v)
+		case []byte:
+			out = append(out, v...)
+		case string:
+			out = append(out, v...)
+		case []uint32:
+			for _, u := range v {
+				out = binary.BigEndian.AppendUint32(out, u)
+			}
+		default:
+			panic("remux: unsupported field type")
+		}
+	}
+	return out
+}
+
+func ftyp(major string, compatible ...string) []byte {
+	payload := fields(major, uint32(512))
+	for _, c := range compatible {
+		payload = append(payload, c...)
+	}
+	return box("ftyp", payload)
+}
+
+// mvhd declares the movie timescale (ms) and duration
+func mvhd(duration uint32, nextTrackID uint32) []byte {
+	return fullBox("mvhd", 0, 0, fields(
+		uint32(0), uint32(0), // creation and modification time
+		uint32(1000), duration,
+		uint32(0x00010000), uint16(0x0100), // rate 1.0, volume 1.0
+		make([]byte, 10),
+		identityMatrix,
+		make([]byte, 24),
+		nextTrackID,
+	))
+}
+
+func trak(t *track, duration uint32, stbl []byte) []byte {
+	volume := uint16(0)
+	if t.kind == audioTrack {
+		volume = 0x0100
+	}
+	tkhd := fullBox("tkhd", 0, 0x3, fields(
+		uint32(0), uint32(0), // creation and modification time
+		t.id, uint32(0), duration,
+		make([]byte, 8),
+		uint16(0), uint16(0), volume, uint16(0), // layer, group, volume
+		identityMatrix,
+		uint32(t.width)<<16, uint32(t.height)<<16,
+	))
+
+	handler, name, header := "vide", "VideoHandler", fullBox("vmhd", 0, 1, make([]byte, 8))
+	if t.kind == audioTrack {
+		handler, name, header = "soun", "SoundHandler", fullBox("smhd", 0, 0, make([]byte, 4))
+	}
+
+	mdhd := fullBox("mdhd", 0, 0, fields(
+		uint32(0), uint32(0),
+		t.timescale, t.mediaDuration,
+		uint16(0x55c4), uint16(0), // language "und"
+	))
+	hdlr := fullBox("hdlr", 0, 0, fields(uint32(0), handler, make([]byte, 12), name, uint8(0)))
+	dinf := box("dinf", fullBox("dref", 0, 0, fields(uint32(1)), fullBox("url ", 0, 1)))
+
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", header, dinf, stbl)))
+}
+
+// stsd describes the codec of a track
+func stsd(t *track) []byte {
+	var entry []byte
+	switch t.kind {
+	case videoTrack:
+		avcC := box("avcC", fields(
+			uint8(1), t.sps[1], t.sps[2], t.sps[3],
+			uint8(0xff),                            // 4-byte NAL lengths
+			uint8(0xe1), uint16(len(t.sps)), t.sps, // one SPS
+			uint8(1), uint16(len(t.pps)), t.pps, // one PPS
+		))
+		entry = box("avc1", fields(
+			make([]byte, 6), uint16(1), // reserved, data reference index
+			make([]byte, 16),
+			uint16(t.width), uint16(t.height),
+			uint32(0x00480000), uint32(0x00480000), // 72 dpi
+			uint32(0), uint16(1), // reserved, frame count
+			make([]byte, 32), // compressor name
+			uint16(0x0018), uint16(0xffff),
+		), avcC)
+	case audioTrack:
+		asc := t.aac.audioSpecificConfig()
+		decoderConfig := descriptor(0x04, fields(
+			uint8(0x40), uint8(0x15), // MPEG-4 audio, audio stream
+			make([]byte, 3), uint32(0), uint32(0), // buffer size, max and average bitrate
+		), descriptor(0x05, asc))
+		esds := fullBox("esds", 0, 0, descriptor(0x03, fields(uint16(0), uint8(0)),
+			decoderConfig, descriptor(0x06, []byte{0x02})))
+		entry = box("mp4a", fields(
+			make([]byte, 6), uint16(1),
+			make([]byte, 8),
+			uint16(t.aac.channels), uint16(16),
+			uint32(0), uint32(t.aac.sampleRate())<<16,
+		), esds)
+	}
+	return fullBox("stsd", 0, 0, fields(uint32(1)), entry)
+}
+
+// descriptor encodes an MPEG-4 elementary stream descriptor
+func descriptor(tag byte, payloads ...[]byte) []byte {
+	size := 0
+	for _, p := range payloads {
+		size += len(p)
+	}
+	out := []byte{tag, 0x80 | byte(size>>21&0x7f), 0x80 | byte(size>>14&0x7f), 0x80 | byte(size>>7&0x7f), byte(size & 0x7f)}
+	for _, p := range payloads {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// emptyStbl is the sample table of a fragmented track, whose samples all
+// live in movie fragments
+func emptyStbl(t *track) []byte {
+	return box("stbl",
+		stsd(t),
+		fullBox("stts", 0, 0, fields(uint32(0))),
+		fullBox("stsc", 0, 0, fields(uint32(0))),
+		fullBox("stsz", 0, 0, fields(uint32(0), uint32(0))),
+		fullBox("stco", 0, 0, fields(uint32(0))),
+	)
+}
+
+// mvex announces that samples follow in movie fragments
+func mvex(tracks []*track) []byte {
+	var trex [][]byte
+	for _, t := range tracks {
+		trex = append(trex, fullBox("trex", 0, 0, fields(t.id, uint32(1), uint32(0), uint32(0), uint32(0))))
+	}
+	return box("mvex", trex...)
+}
+
+// traf describes one track's samples in a movie fragment; dataOffset is
+// the position of the first sample relative to the start of the moof
+func traf(t *track, samples []sample, baseTime uint64, dataOffset int32) []byte {
+	flags := uint32(0x000001 | 0x000100 | 0x000200 | 0x000400) // offset, duration, size, flags
+	if t.kind == videoTrack {
+		flags |= 0x000800 // composition time offsets
+	}
+
+	entries := fields(uint32(len(samples)), dataOffset)
+	for _, s := range samples {
+		sampleFlags := uint32(flagsNonSync)
+		if s.sync {
+			sampleFlags = flagsSync
+		}
+		entries = append(entries, fields(s.duration, s.size, sampleFlags)...)
+		if t.kind == videoTrack {
+			entries = append(entries, fields(uint32(s.cto))...)
+		}
+	}
+
+	return box("traf",
+		fullBox("tfhd", 0, 0x020000, fields(t.id)), // default-base-is-moof
+		fullBox("tfdt", 1, 0, fields(baseTime)),
+		fullBox("trun", 0, flags, entries),
+	)
+}
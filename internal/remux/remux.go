@@ -0,0 +1,703 @@
+// Package remux converts MPEG-TS segments carrying H.264 video and AAC
+// audio to MP4, or to a raw ADTS audio stream, without re-encoding.
+package remux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrNoStreams is returned when the first segment has no H.264 or AAC data
+var ErrNoStreams = errors.New("remux: no H.264 or AAC stream found")
+
+// Format selects the output container
+type Format int
+
+const (
+	// FormatMP4 writes an MP4 with a video and/or audio track
+	FormatMP4 Format = iota
+	// FormatADTS writes the AAC frames as a raw ADTS stream. Video is
+	// dropped and Layout is ignored.
+	FormatADTS
+)
+
+// Layout selects how samples are arranged in the MP4
+type Layout int
+
+const (
+	// Fragmented writes one movie fragment per segment as segments
+	// arrive, so output starts immediately
+	Fragmented Layout = iota
+	// Progressive writes a single sample table ahead of the media, which
+	// some editors require. Media is spooled to a temporary file and
+	// nothing is written until Close.
+	Progressive
+)
+
+// Options configures a Remuxer
+type Options struct {
+	Format    Format
+	Layout    Layout
+	AudioOnly bool // Drop the video track
+
+	// Start and End trim the output, measured from the first timestamp of
+	// the first segment written. Video starts at the last keyframe at or
+	// before Start, so Start should fall within the first segment. A zero
+	// End keeps everything after Start.
+	Start time.Duration
+	End   time.Duration
+}
+
+type trackKind int
+
+const (
+	videoTrack trackKind = iota
+	audioTrack
+)
+
+// sample is one access unit or audio frame
+type sample struct {
+	data     []byte // nil once spooled
+	dts      int64  // 90 kHz, unwrapped
+	duration uint32
+	size     uint32
+	cto      int32 // composition time offset
+	sync     bool
+}
+
+// chunk is a run of consecutive samples in the spooled media
+type chunk struct {
+	offset int64
+	count  int
+}
+
+type track struct {
+	id            uint32
+	kind          trackKind
+	timescale     uint32
+	width, height int
+	sps, pps      []byte
+	aac           aacConfig
+
+	pending      []sample // video samples waiting for the next DTS
+	lastDuration uint32
+	decodeTime   uint64 // decode time of the next emitted sample
+	startOffset  uint64 // decode time of the first sample
+
+	// Progressive layout bookkeeping
+	samples       []sample
+	chunks        []chunk
+	mediaDuration uint32
+}
+
+// Remuxer converts a sequence of TS segments from one stream into an MP4
+// or ADTS stream written to w
+type Remuxer struct {
+	w      io.Writer
+	opts   Options
+	demux  *demuxer
+	tracks []*track
+	video  *track
+	audio  *track
+
+	origin       int64 // first timestamp of the first segment, 90 kHz
+	start        int64 // timestamp of output time zero, 90 kHz
+	lastVideo    int64 // previous unwrapped timestamps
+	lastAudio    int64
+	sps, pps     []byte
+	aac          aacConfig
+	videoStarted bool
+	seq          uint32
+
+	spool     *os.File
+	spoolSize int64
+}
+
+// New creates a remuxer writing to w
+func New(w io.Writer, opts Options) *Remuxer {
+	if opts.Format == FormatADTS {
+		opts.AudioOnly = true
+	}
+	return &Remuxer{
+		w:         w,
+		opts:      opts,
+		demux:     newDemuxer(),
+		origin:    -1,
+		lastVideo: -1,
+		lastAudio: -1,
+	}
+}
+
+// WriteSegment remuxes one TS segment. Segments must be passed in order.
+// An error from the first segment means nothing has been written yet.
+func (r *Remuxer) WriteSegment(data []byte) error {
+	videoPES, audioPES, err := r.demux.segment(data)
+	if err != nil {
+		return err
+	}
+
+	video := r.videoSamples(videoPES)
+	audio, err := r.audioSamples(audioPES)
+	if err != nil {
+		return err
+	}
+
+	if r.origin < 0 {
+		switch {
+		case len(video) > 0 && (len(audio) == 0 || video[0].dts <= audio[0].dts):
+			r.origin = video[0].dts
+		case len(audio) > 0:
+			r.origin = audio[0].dts
+		default:
+			return ErrNoStreams
+		}
+	}
+	if r.opts.AudioOnly {
+		video = nil
+	}
+
+	video = r.trimVideo(video)
+	audio = r.trim(audio)
+
+	if r.tracks == nil {
+		// Wait until every stream present has samples in range, so video
+		// starts on a keyframe and no track is left out
+		hasVideo := r.sps != nil && !r.opts.AudioOnly
+		hasAudio := r.aac.objectType != 0
+		if (hasVideo && len(video) == 0) || (hasAudio && len(audio) == 0) || (len(video) == 0 && len(audio) == 0) {
+			return nil
+		}
+		if err := r.init(video, audio); err != nil {
+			return err
+		}
+	}
+
+	var emitted [2][]sample
+	if r.video != nil {
+		emitted[0] = r.queueVideo(video)
+	}
+	if r.audio != nil {
+		emitted[1] = audio
+	}
+	return r.emit(emitted)
+}
+
+// Close flushes the remaining samples and, for the progressive layout,
+// writes the whole file
+func (r *Remuxer) Close() error {
+	defer r.removeSpool()
+	if r.tracks == nil {
+		return ErrNoStreams
+	}
+
+	var emitted [2][]sample
+	if r.video != nil && len(r.video.pending) > 0 {
+		last := r.video.pending[0]
+		last.duration = r.video.lastDuration
+		r.video.pending = nil
+		emitted[0] = []sample{last}
+	}
+	if err := r.emit(emitted); err != nil {
+		return err
+	}
+
+	if r.opts.Format == FormatMP4 && r.opts.Layout == Progressive {
+		return r.writeProgressive()
+	}
+	return nil
+}
+
+// Abort gives up on the output after a failed segment. Nothing more is
+// written; for the progressive layout that means no file at all.
+func (r *Remuxer) Abort() {
+	r.removeSpool()
+}
+
+func (r *Remuxer) removeSpool() {
+	if r.spool != nil {
+		r.spool.Close()
+		os.Remove(r.spool.Name())
+		r.spool = nil
+	}
+}
+
+// videoSamples converts PES packets to MP4 samples with unwrapped DTS
+func (r *Remuxer) videoSamples(packets []pes) []sample {
+	var samples []sample
+	prev := r.lastVideo
+	if prev < 0 {
+		prev = r.lastAudio
+	}
+
+	for _, p := range packets {
+		data, sps, pps, keyframe := accessUnit(p.data)
+		if sps != nil {
+			r.sps = sps
+		}
+		if pps != nil {
+			r.pps = pps
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		dts := p.dts
+		if prev >= 0 {
+			dts = unwrap(prev, p.dts)
+		}
+		prev = dts
+		pts := unwrap(dts, p.pts)
+
+		cto := int32(pts - dts)
+		if cto < 0 {
+			cto = 0
+		}
+		samples = append(samples, sample{
+			data: data,
+			dts:  dts,
+			size: uint32(len(data)),
+			cto:  cto,
+			sync: keyframe,
+		})
+	}
+
+	if len(samples) > 0 {
+		r.lastVideo = prev
+	}
+	return samples
+}
+
+// audioSamples splits ADTS PES packets into raw AAC frames, timestamped
+// from the packet PTS
+func (r *Remuxer) audioSamples(packets []pes) ([]sample, error) {
+	var samples []sample
+	prev := r.lastAudio
+	if prev < 0 {
+		prev = r.lastVideo
+	}
+
+	for _, p := range packets {
+		frames, config, err := splitADTS(p.data)
+		if err != nil {
+			return nil, err
+		}
+		if len(frames) == 0 {
+			continue
+		}
+		r.aac = config
+
+		pts := p.pts
+		if prev >= 0 {
+			pts = unwrap(prev, p.pts)
+		}
+		prev = pts
+
+		for i, f := range frames {
+			samples = append(samples, sample{
+				data:     f,
+				dts:      pts + int64(i)*aacFrameSamples*tsClock/int64(config.sampleRate()),
+				duration: aacFrameSamples,
+				size:     uint32(len(f)),
+				sync:     true,
+			})
+		}
+	}
+
+	if len(samples) > 0 {
+		r.lastAudio = prev
+	}
+	return samples, nil
+}
+
+// ticks converts a duration to 90 kHz clock ticks
+func ticks(d time.Duration) int64 {
+	return int64(d) * tsClock / int64(time.Second)
+}
+
+// trimVideo drops video before the keyframe that covers Start, then
+// applies End
+func (r *Remuxer) trimVideo(samples []sample) []sample {
+	if !r.videoStarted {
+		start := r.origin + ticks(r.opts.Start)
+		if len(samples) == 0 || samples[len(samples)-1].dts < start {
+			// The range begins in a later segment
+			return nil
+		}
+		first := -1
+		for i, s := range samples {
+			if !s.sync {
+				continue
+			}
+			if s.dts <= start || first < 0 {
+				first = i
+			}
+			if s.dts > start {
+				break
+			}
+		}
+		if first < 0 {
+			return nil
+		}
+		r.videoStarted = true
+		samples = samples[first:]
+	}
+	return r.trimEnd(samples)
+}
+
+// trim drops samples outside Start and End
+func (r *Remuxer) trim(samples []sample) []sample {
+	start := r.origin + ticks(r.opts.Start)
+	for len(samples) > 0 && samples[0].dts < start {
+		samples = samples[1:]
+	}
+	return r.trimEnd(samples)
+}
+
+func (r *Remuxer) trimEnd(samples []sample) []sample {
+	if r.opts.End <= 0 {
+		return samples
+	}
+	end := r.origin + ticks(r.opts.End)
+	for i, s := range samples {
+		if s.dts >= end {
+			return samples[:i]
+		}
+	}
+	return samples
+}
+
+// init sets up the tracks from the first samples in range and writes
+// the MP4 initialization segment for the fragmented layout
+func (r *Remuxer) init(video, audio []sample) error {
+	if len(video) > 0 {
+		if r.sps == nil || r.pps == nil {
+			return ErrNoStreams
+		}
+		width, height, err := spsDimensions(r.sps)
+		if err != nil {
+			return err
+		}
+		r.video = &track{
+			kind:      videoTrack,
+			timescale: tsClock,
+			width:     width,
+			height:    height,
+			sps:       r.sps,
+			pps:       r.pps,
+		}
+		r.tracks = append(r.tracks, r.video)
+	}
+	if len(audio) > 0 {
+		r.audio = &track{
+			kind:      audioTrack,
+			timescale: uint32(r.aac.sampleRate()),
+			aac:       r.aac,
+		}
+		r.tracks = append(r.tracks, r.audio)
+	}
+
+	switch {
+	case r.video != nil && (r.audio == nil || video[0].dts <= audio[0].dts):
+		r.start = video[0].dts
+	default:
+		r.start = audio[0].dts
+	}
+	if r.video != nil {
+		r.video.startOffset = uint64(video[0].dts - r.start)
+		r.video.decodeTime = r.video.startOffset
+	}
+	if r.audio != nil {
+		r.audio.startOffset = uint64(audio[0].dts-r.start) * uint64(r.audio.timescale) / tsClock
+		r.audio.decodeTime = r.audio.startOffset
+	}
+	for i, t := range r.tracks {
+		t.id = uint32(i + 1)
+	}
+
+	switch {
+	case r.opts.Format == FormatADTS:
+		return nil
+	case r.opts.Layout == Progressive:
+		spool, err := os.CreateTemp("", "remux-*.mdat")
+		if err != nil {
+			return err
+		}
+		r.spool = spool
+		return nil
+	}
+
+	var traks [][]byte
+	for _, t := range r.tracks {
+		traks = append(traks, trak(t, 0, emptyStbl(t)))
+	}
+	moov := box("moov", append(append([][]byte{mvhd(0, uint32(len(r.tracks)+1))}, traks...), mvex(r.tracks))...)
+	_, err := r.w.Write(append(r.ftyp(), moov...))
+	return err
+}
+
+func (r *Remuxer) ftyp() []byte {
+	brands := []string{"isom", "iso2", "mp41"}
+	if r.opts.Layout == Fragmented {
+		brands = []string{"isom", "iso5", "iso6", "mp41"}
+	}
+	if r.video != nil {
+		brands = append(brands, "avc1")
+	}
+	return ftyp("isom", brands...)
+}
+
+// queueVideo adds samples behind the held back one and returns those
+// whose duration is now known from the next sample's DTS
+func (r *Remuxer) queueVideo(samples []sample) []sample {
+	t := r.video
+	t.pending = append(t.pending, samples...)
+	if len(t.pending) < 2 {
+		return nil
+	}
+
+	ready := t.pending[:len(t.pending)-1]
+	for i := range ready {
+		d := t.pending[i+1].dts - ready[i].dts
+		if d <= 0 || d > tsClock*10 {
+			d = int64(t.lastDuration)
+			if d == 0 {
+				d = tsClock / 25
+			}
+		}
+		ready[i].duration = uint32(d)
+		t.lastDuration = uint32(d)
+	}
+	t.pending = []sample{t.pending[len(t.pending)-1]}
+	return ready
+}
+
+// emit writes a movie fragment, spools the samples or writes ADTS
+// frames, per format and layout
+func (r *Remuxer) emit(samples [2][]sample) error {
+	if len(samples[0]) == 0 && len(samples[1]) == 0 {
+		return nil
+	}
+	switch {
+	case r.opts.Format == FormatADTS:
+		return r.writeADTS(samples[1])
+	case r.opts.Layout == Progressive:
+		return r.spoolSamples(samples)
+	}
+
+	type run struct {
+		t        *track
+		samples  []sample
+		baseTime uint64
+	}
+	var runs []run
+	for i, t := range []*track{r.video, r.audio} {
+		if t == nil || len(samples[i]) == 0 {
+			continue
+		}
+		runs = append(runs, run{t: t, samples: samples[i], baseTime: t.decodeTime})
+		for _, s := range samples[i] {
+			t.decodeTime += uint64(s.duration)
+		}
+	}
+
+	r.seq++
+	build := func(offsets []int32) []byte {
+		parts := [][]byte{fullBox("mfhd", 0, 0, fields(r.seq))}
+		for i, run := range runs {
+			parts = append(parts, traf(run.t, run.samples, run.baseTime, offsets[i]))
+		}
+		return box("moof", parts...)
+	}
+
+	// The moof size doesn't depend on the offsets, so build it twice
+	offsets := make([]int32, len(runs))
+	moofSize := len(build(offsets))
+	mdatSize := 8
+	for i, run := range runs {
+		offsets[i] = int32(moofSize + mdatSize)
+		for _, s := range run.samples {
+			mdatSize += len(s.data)
+		}
+	}
+
+	out := build(offsets)
+	out = binary.BigEndian.AppendUint32(out, uint32(mdatSize))
+	out = append(out, "mdat"...)
+	if _, err := r.w.Write(out); err != nil {
+		return err
+	}
+	for _, run := range runs {
+		for _, s := range run.samples {
+			if _, err := r.w.Write(s.data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeADTS writes AAC frames with their ADTS headers restored
+func (r *Remuxer) writeADTS(samples []sample) error {
+	for _, s := range samples {
+		if _, err := r.w.Write(append(r.audio.aac.adtsHeader(len(s.data)), s.data...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spoolSamples appends sample data to the spool file, one chunk per track
+func (r *Remuxer) spoolSamples(samples [2][]sample) error {
+	for i, t := range []*track{r.video, r.audio} {
+		if t == nil || len(samples[i]) == 0 {
+			continue
+		}
+		t.chunks = append(t.chunks, chunk{offset: r.spoolSize, count: len(samples[i])})
+		for _, s := range samples[i] {
+			n, err := r.spool.Write(s.data)
+			r.spoolSize += int64(n)
+			if err != nil {
+				return err
+			}
+			s.data = nil
+			t.samples = append(t.samples, s)
+			t.mediaDuration += s.duration
+		}
+	}
+	return nil
+}
+
+// writeProgressive writes ftyp, moov and the spooled media as one mdat
+func (r *Remuxer) writeProgressive() error {
+	large := r.spoolSize+8 > 1<<32-1
+	mdatHeader := 8
+	if large {
+		mdatHeader = 16
+	}
+
+	ftyp := r.ftyp()
+	moov := r.moov(0, large)
+	moov = r.moov(int64(len(ftyp)+len(moov)+mdatHeader), large)
+
+	header := append(ftyp, moov...)
+	if large {
+		header = binary.BigEndian.AppendUint32(header, 1)
+		header = append(header, "mdat"...)
+		header = binary.BigEndian.AppendUint64(header, uint64(r.spoolSize+16))
+	} else {
+		header = binary.BigEndian.AppendUint32(header, uint32(r.spoolSize+8))
+		header = append(header, "mdat"...)
+	}
+	if _, err := r.w.Write(header); err != nil {
+		return err
+	}
+
+	if _, err := r.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(r.w, r.spool)
+	return err
+}
+
+// moov builds the progressive movie box with chunk offsets shifted by base
+func (r *Remuxer) moov(base int64, co64 bool) []byte {
+	var (
+		traks    [][]byte
+		duration uint32
+	)
+	for _, t := range r.tracks {
+		start := uint32(t.startOffset * 1000 / uint64(t.timescale))
+		length := uint32(uint64(t.mediaDuration) * 1000 / uint64(t.timescale))
+		if start+length > duration {
+			duration = start + length
+		}
+
+		trakBox := trak(t, start+length, sampleTable(t, base, co64))
+		if start > 0 {
+			// Delay the track with an empty edit so tracks stay in sync
+			edts := box("edts", fullBox("elst", 0, 0, fields(
+				uint32(2),
+				start, int32(-1), uint32(0x00010000),
+				length, int32(0), uint32(0x00010000),
+			)))
+			// Insert the edit list after tkhd
+			tkhdSize := binary.BigEndian.Uint32(trakBox[8:12])
+			trakBox = box("trak", trakBox[8:8+tkhdSize], edts, trakBox[8+tkhdSize:])
+		}
+		traks = append(traks, trakBox)
+	}
+	return box("moov", append([][]byte{mvhd(duration, uint32(len(r.tracks)+1))}, traks...)...)
+}
+
+// sampleTable builds the stbl of a progressive track
+func sampleTable(t *track, base int64, co64 bool) []byte {
+	var stts, ctts, stss, stsc, sizes []byte
+	var sttsCount, cttsCount, stssCount, stscCount uint32
+	hasCTS := false
+
+	for i := 0; i < len(t.samples); {
+		j := i + 1
+		for j < len(t.samples) && t.samples[j].duration == t.samples[i].duration {
+			j++
+		}
+		stts = append(stts, fields(uint32(j-i), t.samples[i].duration)...)
+		sttsCount++
+		i = j
+	}
+	for i := 0; i < len(t.samples); {
+		j := i + 1
+		for j < len(t.samples) && t.samples[j].cto == t.samples[i].cto {
+			j++
+		}
+		if t.samples[i].cto != 0 {
+			hasCTS = true
+		}
+		ctts = append(ctts, fields(uint32(j-i), uint32(t.samples[i].cto))...)
+		cttsCount++
+		i = j
+	}
+	for i, s := range t.samples {
+		sizes = append(sizes, fields(s.size)...)
+		if s.sync {
+			stss = append(stss, fields(uint32(i+1))...)
+			stssCount++
+		}
+	}
+
+	var offsets []byte
+	for i, c := range t.chunks {
+		if i == 0 || c.count != t.chunks[i-1].count {
+			stsc = append(stsc, fields(uint32(i+1), uint32(c.count), uint32(1))...)
+			stscCount++
+		}
+		if co64 {
+			offsets = append(offsets, fields(uint64(base+c.offset))...)
+		} else {
+			offsets = append(offsets, fields(uint32(base+c.offset))...)
+		}
+	}
+
+	boxes := [][]byte{
+		stsd(t),
+		fullBox("stts", 0, 0, fields(sttsCount), stts),
+	}
+	if hasCTS {
+		boxes = append(boxes, fullBox("ctts", 0, 0, fields(cttsCount), ctts))
+	}
+	if t.kind == videoTrack {
+		boxes = append(boxes, fullBox("stss", 0, 0, fields(stssCount), stss))
+	}
+	boxes = append(boxes,
+		fullBox("stsc", 0, 0, fields(stscCount), stsc),
+		fullBox("stsz", 0, 0, fields(uint32(0), uint32(len(t.samples))), sizes),
+	)
+	if co64 {
+		boxes = append(boxes, fullBox("co64", 0, 0, fields(uint32(len(t.chunks))), offsets))
+	} else {
+		boxes = append(boxes, fullBox("stco", 0, 0, fields(uint32(len(t.chunks))), offsets))
+	}
+	return box("stbl", boxes...)
+}
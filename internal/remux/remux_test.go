@@ -0,0 +1,660 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// The fixture is 25 fps H.264 with a keyframe every 24 frames and 48 kHz
+// AAC in 1.92 s segments, so each segment holds exactly 48 video frames
+// and 90 audio frames
+const (
+	fixtureFrameTicks = tsClock / 25
+	fixtureAudioTicks = aacFrameSamples * tsClock / 48000
+	fixtureFrames     = 48
+	fixtureAudio      = 90
+	fixtureGOP        = 24
+	fixtureBase       = 10 * tsClock // first DTS
+	fixtureCTO        = 2 * fixtureFrameTicks
+)
+
+var fixtureAAC = aacConfig{objectType: 2, rateIndex: 3, channels: 2}
+
+func TestFragmented(t *testing.T) {
+	var out bytes.Buffer
+	r := New(&out, Options{})
+	for i := 0; i < 2; i++ {
+		if err := r.WriteSegment(fixtureSegment(i)); err != nil {
+			t.Fatalf("WriteSegment(%d): %v", i, err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	top := children(t, out.Bytes())
+	if len(top) < 4 || top[0].typ != "ftyp" || top[1].typ != "moov" {
+		t.Fatalf("top-level boxes = %v", boxTypes(top))
+	}
+	moov := top[1].payload
+	if n := len(all(t, moov, "trak")); n != 2 {
+		t.Fatalf("got %d traks", n)
+	}
+	if n := len(all(t, child(t, moov, "mvex"), "trex")); n != 2 {
+		t.Errorf("got %d trex", n)
+	}
+	checkVideoEntry(t, moov)
+
+	// Each moof is followed by its mdat, and the trun data offsets point
+	// into it back to back
+	var (
+		counts    [3]int
+		durations [3]uint64
+		fragments int
+	)
+	for i := 2; i < len(top); i += 2 {
+		if top[i].typ != "moof" || i+1 >= len(top) || top[i+1].typ != "mdat" {
+			t.Fatalf("top-level boxes = %v", boxTypes(top))
+		}
+		fragments++
+		mdatStart := top[i+1].offset + 8 - top[i].offset
+		next := mdatStart
+		for _, traf := range all(t, top[i].payload, "traf") {
+			id := binary.BigEndian.Uint32(child(t, traf, "tfhd")[4:])
+			baseTime := binary.BigEndian.Uint64(child(t, traf, "tfdt")[4:])
+			if baseTime != durations[id] {
+				t.Errorf("fragment %d track %d: tfdt = %d, want %d", fragments, id, baseTime, durations[id])
+			}
+			run := parseTrun(t, child(t, traf, "trun"), id == 1)
+			if run.dataOffset != next {
+				t.Errorf("fragment %d track %d: data offset = %d, want %d", fragments, id, run.dataOffset, next)
+			}
+			next += run.size
+			counts[id] += len(run.durations)
+			for _, d := range run.durations {
+				durations[id] += uint64(d)
+			}
+			if id == 1 && fragments == 1 && !run.sync[0] {
+				t.Error("first video sample is not a keyframe")
+			}
+			if id == 1 && run.cto != fixtureCTO {
+				t.Errorf("composition offset = %d, want %d", run.cto, fixtureCTO)
+			}
+		}
+		if next != mdatStart+len(top[i+1].payload) {
+			t.Errorf("fragment %d: samples cover %d bytes of a %d byte mdat", fragments, next-mdatStart, len(top[i+1].payload))
+		}
+	}
+
+	if counts[1] != 2*fixtureFrames || durations[1] != 2*fixtureFrames*fixtureFrameTicks {
+		t.Errorf("video: %d samples over %d ticks", counts[1], durations[1])
+	}
+	if counts[2] != 2*fixtureAudio || durations[2] != 2*fixtureAudio*aacFrameSamples {
+		t.Errorf("audio: %d samples over %d ticks", counts[2], durations[2])
+	}
+}
+
+func TestProgressive(t *testing.T) {
+	var out bytes.Buffer
+	r := New(&out, Options{Layout: Progressive})
+	for i := 0; i < 2; i++ {
+		if err := r.WriteSegment(fixtureSegment(i)); err != nil {
+			t.Fatalf("WriteSegment(%d): %v", i, err)
+		}
+	}
+	if out.Len() != 0 {
+		t.Errorf("wrote %d bytes before Close", out.Len())
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	top := children(t, out.Bytes())
+	if got := boxTypes(top); len(got) != 3 || got[0] != "ftyp" || got[1] != "moov" || got[2] != "mdat" {
+		t.Fatalf("top-level boxes = %v", got)
+	}
+	mdat := top[2]
+	traks := all(t, top[1].payload, "trak")
+	if len(traks) != 2 {
+		t.Fatalf("got %d traks", len(traks))
+	}
+	checkVideoEntry(t, top[1].payload)
+
+	video := parseTable(t, traks[0], out.Bytes(), mdat)
+	if video.count != 2*fixtureFrames || video.duration != 2*fixtureFrames*fixtureFrameTicks {
+		t.Errorf("video: %d samples over %d ticks", video.count, video.duration)
+	}
+	if want := []uint32{1, 25, 49, 73}; !slices.Equal(video.sync, want) {
+		t.Errorf("sync samples = %v, want %v", video.sync, want)
+	}
+	if !video.ctts {
+		t.Error("video track has no ctts")
+	}
+
+	audio := parseTable(t, traks[1], out.Bytes(), mdat)
+	if audio.count != 2*fixtureAudio || audio.duration != 2*fixtureAudio*aacFrameSamples {
+		t.Errorf("audio: %d samples over %d ticks", audio.count, audio.duration)
+	}
+	if video.size+audio.size != int64(len(mdat.payload)) {
+		t.Errorf("samples cover %d bytes of a %d byte mdat", video.size+audio.size, len(mdat.payload))
+	}
+}
+
+func TestAbortProgressive(t *testing.T) {
+	var out bytes.Buffer
+	r := New(&out, Options{Layout: Progressive})
+	if err := r.WriteSegment(fixtureSegment(0)); err != nil {
+		t.Fatalf("WriteSegment: %v", err)
+	}
+	spool := r.spool.Name()
+	if err := r.WriteSegment(make([]byte, tsPacketSize)); err == nil {
+		t.Fatal("WriteSegment of a broken segment succeeded")
+	}
+	r.Abort()
+	if out.Len() != 0 {
+		t.Errorf("wrote %d bytes for a failed remux", out.Len())
+	}
+	if _, err := os.Stat(spool); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("spool file left behind: %v", err)
+	}
+}
+
+func TestTrim(t *testing.T) {
+	var out bytes.Buffer
+	r := New(&out, Options{Layout: Progressive, Start: 1500 * time.Millisecond, End: 3 * time.Second})
+	for i := 0; i < 2; i++ {
+		if err := r.WriteSegment(fixtureSegment(i)); err != nil {
+			t.Fatalf("WriteSegment(%d): %v", i, err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	top := children(t, out.Bytes())
+	traks := all(t, top[1].payload, "trak")
+	mdat := top[2]
+
+	// Video starts at the keyframe at 0.96 s and ends before 3 s
+	video := parseTable(t, traks[0], out.Bytes(), mdat)
+	if want := 75 - fixtureGOP; video.count != want {
+		t.Errorf("video: %d samples, want %d", video.count, want)
+	}
+	if want := []uint32{1, 25, 49}; !slices.Equal(video.sync, want) {
+		t.Errorf("sync samples = %v, want %v", video.sync, want)
+	}
+
+	// Audio starts at the first frame at or after 1.5 s, frame 71, and is
+	// delayed against the video by an edit list
+	audio := parseTable(t, traks[1], out.Bytes(), mdat)
+	if want := 141 - 71; audio.count != want {
+		t.Errorf("audio: %d samples, want %d", audio.count, want)
+	}
+	if video.edit != 0 {
+		t.Errorf("video delayed by %d ms", video.edit)
+	}
+	if want := uint32((71*fixtureAudioTicks - fixtureGOP*fixtureFrameTicks) * 1000 / tsClock); audio.edit != want {
+		t.Errorf("audio delayed by %d ms, want %d", audio.edit, want)
+	}
+}
+
+func TestTrimLaterSegment(t *testing.T) {
+	var out bytes.Buffer
+	r := New(&out, Options{Start: 2 * time.Second})
+	for i := 0; i < 2; i++ {
+		if err := r.WriteSegment(fixtureSegment(i)); err != nil {
+			t.Fatalf("WriteSegment(%d): %v", i, err)
+		}
+		if i == 0 && out.Len() != 0 {
+			t.Errorf("wrote %d bytes for a segment before Start", out.Len())
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	var video int
+	for _, b := range children(t, out.Bytes()) {
+		if b.typ != "moof" {
+			continue
+		}
+		for _, traf := range all(t, b.payload, "traf") {
+			if binary.BigEndian.Uint32(child(t, traf, "tfhd")[4:]) == 1 {
+				video += len(parseTrun(t, child(t, traf, "trun"), true).durations)
+			}
+		}
+	}
+	// The first keyframe of the second segment, at 1.92 s
+	if video != fixtureFrames {
+		t.Errorf("video: %d samples, want %d", video, fixtureFrames)
+	}
+}
+
+func TestAudioOnly(t *testing.T) {
+	var out bytes.Buffer
+	r := New(&out, Options{AudioOnly: true, Layout: Progressive})
+	if err := r.WriteSegment(fixtureSegment(0)); err != nil {
+		t.Fatalf("WriteSegment: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	top := children(t, out.Bytes())
+	traks := all(t, top[1].payload, "trak")
+	if len(traks) != 1 {
+		t.Fatalf("got %d traks", len(traks))
+	}
+	if audio := parseTable(t, traks[0], out.Bytes(), top[2]); audio.count != fixtureAudio {
+		t.Errorf("audio: %d samples", audio.count)
+	}
+}
+
+func TestADTS(t *testing.T) {
+	var out bytes.Buffer
+	r := New(&out, Options{Format: FormatADTS})
+	for i := 0; i < 2; i++ {
+		if err := r.WriteSegment(fixtureSegment(i)); err != nil {
+			t.Fatalf("WriteSegment(%d): %v", i, err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	frames, config, err := splitADTS(out.Bytes())
+	if err != nil {
+		t.Fatalf("output is not ADTS: %v", err)
+	}
+	if len(frames) != 2*fixtureAudio || config != fixtureAAC {
+		t.Errorf("got %d frames of %+v", len(frames), config)
+	}
+}
+
+func TestNoStreams(t *testing.T) {
+	r := New(&bytes.Buffer{}, Options{})
+	if err := r.WriteSegment(tsPackets(0, true, psiPAT())); !errors.Is(err, ErrNoStreams) {
+		t.Errorf("WriteSegment = %v, want ErrNoStreams", err)
+	}
+	if err := r.Close(); !errors.Is(err, ErrNoStreams) {
+		t.Errorf("Close = %v, want ErrNoStreams", err)
+	}
+	if err := New(&bytes.Buffer{}, Options{}).WriteSegment(make([]byte, tsPacketSize)); !errors.Is(err, errNoSync) {
+		t.Errorf("WriteSegment = %v, want errNoSync", err)
+	}
+}
+
+func TestSPSDimensions(t *testing.T) {
+	width, height, err := spsDimensions(fixtureSPS())
+	if err != nil || width != 320 || height != 240 {
+		t.Errorf("spsDimensions = %d, %d, %v", width, height, err)
+	}
+}
+
+func TestSPSDimensionsMalformed(t *testing.T) {
+	// pic_order_cnt_type 1 with n offsets, then nothing
+	pocType1 := func(n uint32) []byte {
+		var w bitWriter
+		w.bits(0x67, 8)
+		w.bits(66, 8)
+		w.bits(0, 8)
+		w.bits(30, 8)
+		w.ue(0) // seq_parameter_set_id
+		w.ue(0) // log2_max_frame_num_minus4
+		w.ue(1) // pic_order_cnt_type
+		w.bits(0, 1)
+		w.ue(0)
+		w.ue(0)
+		w.ue(n) // num_ref_frames_in_pic_order_cnt_cycle
+		return w.bytes()
+	}
+	tests := []struct {
+		name string
+		sps  []byte
+	}{
+		{"truncated", fixtureSPS()[:4]},
+		{"cycle over 255", pocType1(256)},
+		{"huge cycle", pocType1(1<<32 - 2)},
+		{"cycle past the end", pocType1(200)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := spsDimensions(tt.sps); !errors.Is(err, errBadSPS) {
+				t.Errorf("spsDimensions = %v, want errBadSPS", err)
+			}
+		})
+	}
+}
+
+func TestUnwrap(t *testing.T) {
+	tests := []struct{ prev, ts, want int64 }{
+		{100, 200, 200},
+		{ptsWrap - 100, 50, ptsWrap + 50},
+		{ptsWrap + 50, ptsWrap - 100, ptsWrap - 100},
+		{ptsWrap + 50, 100, ptsWrap + 100},
+	}
+	for _, tt := range tests {
+		if got := unwrap(tt.prev, tt.ts%ptsWrap); got != tt.want {
+			t.Errorf("unwrap(%d, %d) = %d, want %d", tt.prev, tt.ts%ptsWrap, got, tt.want)
+		}
+	}
+}
+
+func checkVideoEntry(t *testing.T, moov []byte) {
+	t.Helper()
+	trak := all(t, moov, "trak")[0]
+	tkhd := child(t, trak, "tkhd")
+	width, height := binary.BigEndian.Uint32(tkhd[76:]), binary.BigEndian.Uint32(tkhd[80:])
+	if width != 320<<16 || height != 240<<16 {
+		t.Errorf("tkhd size = %dx%d", width>>16, height>>16)
+	}
+	stsd := child(t, trak, "mdia", "minf", "stbl", "stsd")
+	if entry := children(t, stsd[8:]); len(entry) != 1 || entry[0].typ != "avc1" {
+		t.Errorf("stsd entries = %v", boxTypes(entry))
+	}
+}
+
+// Fixture
+
+// fixtureSegment returns segment i of the fixture stream
+func fixtureSegment(i int) []byte {
+	seg := append(tsPackets(0, true, psiPAT()), tsPackets(0x1000, true, psiPMT())...)
+	base := int64(fixtureBase + i*fixtureFrames*fixtureFrameTicks)
+
+	for f := 0; f < fixtureFrames; f++ {
+		dts := base + int64(f*fixtureFrameTicks)
+		au := nalu(nalAUD, 0xf0)
+		if f%fixtureGOP == 0 {
+			au = append(au, nalu(fixtureSPS()[0], fixtureSPS()[1:]...)...)
+			au = append(au, nalu(nalPPS|0x60, 0xce, 0x3c, 0x80)...)
+			au = append(au, nalu(nalIDR|0x60, bytes.Repeat([]byte{0x88}, 300)...)...)
+		} else {
+			au = append(au, nalu(1|0x40, bytes.Repeat([]byte{0x9a}, 100+f)...)...)
+		}
+		seg = append(seg, tsPackets(0x100, true, pesPacket(0xe0, dts+fixtureCTO, dts, au))...)
+	}
+
+	// Six ADTS frames per PES packet
+	for a := 0; a < fixtureAudio; a += 6 {
+		var data []byte
+		for k := 0; k < 6; k++ {
+			frame := bytes.Repeat([]byte{byte(0x21 + k)}, 50+a+k)
+			data = append(data, fixtureAAC.adtsHeader(len(frame))...)
+			data = append(data, frame...)
+		}
+		pts := base + int64(a*fixtureAudioTicks)
+		seg = append(seg, tsPackets(0x101, true, pesPacket(0xc0, pts, pts, data))...)
+	}
+	return seg
+}
+
+// fixtureSPS is a baseline profile SPS for 320x240
+func fixtureSPS() []byte {
+	var w bitWriter
+	w.bits(0x67, 8) // NAL header
+	w.bits(66, 8)   // profile_idc
+	w.bits(0, 8)    // constraint flags
+	w.bits(30, 8)   // level_idc
+	w.ue(0)         // seq_parameter_set_id
+	w.ue(0)         // log2_max_frame_num_minus4
+	w.ue(2)         // pic_order_cnt_type
+	w.ue(1)         // max_num_ref_frames
+	w.bits(0, 1)    // gaps_in_frame_num_value_allowed_flag
+	w.ue(320/16 - 1)
+	w.ue(240/16 - 1)
+	w.bits(1, 1) // frame_mbs_only_flag
+	w.bits(1, 1) // direct_8x8_inference_flag
+	w.bits(0, 1) // frame_cropping_flag
+	w.bits(0, 1) // vui_parameters_present_flag
+	w.bits(1, 1) // rbsp_stop_one_bit
+	return w.bytes()
+}
+
+type bitWriter struct {
+	out  []byte
+	used int // bits used in the last byte
+}
+
+func (w *bitWriter) bits(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.used == 0 {
+			w.out = append(w.out, 0)
+		}
+		w.out[len(w.out)-1] |= byte(v>>i&1) << (7 - w.used)
+		w.used = (w.used + 1) % 8
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	v++
+	n := 0
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v, n+1)
+}
+
+func (w *bitWriter) bytes() []byte {
+	return w.out
+}
+
+func nalu(header byte, payload ...byte) []byte {
+	return append([]byte{0, 0, 0, 1, header}, payload...)
+}
+
+func pesPacket(streamID byte, pts, dts int64, data []byte) []byte {
+	header := []byte{0, 0, 1, streamID, 0, 0, 0x80, 0xc0, 10}
+	header = append(header, timestamp(0x3, pts)...)
+	header = append(header, timestamp(0x1, dts)...)
+	if n := len(header) - 6 + len(data); n <= 0xffff {
+		binary.BigEndian.PutUint16(header[4:], uint16(n))
+	}
+	return append(header, data...)
+}
+
+func timestamp(prefix byte, ts int64) []byte {
+	return []byte{
+		prefix<<4 | byte(ts>>29&0x0e) | 1,
+		byte(ts >> 22),
+		byte(ts>>14&0xfe) | 1,
+		byte(ts >> 7),
+		byte(ts<<1&0xfe) | 1,
+	}
+}
+
+func psiPAT() []byte {
+	return psi(0x00, []byte{0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00})
+}
+
+func psiPMT() []byte {
+	return psi(0x02, []byte{
+		0, 1, 0xc1, 0, 0,
+		0xe1, 0x00, // PCR PID
+		0xf0, 0x00, // program info length
+		streamTypeH264, 0xe1, 0x00, 0xf0, 0x00,
+		streamTypeAAC, 0xe1, 0x01, 0xf0, 0x00,
+	})
+}
+
+// psi returns a section with a pointer field and a dummy CRC
+func psi(tableID byte, body []byte) []byte {
+	n := len(body) + 4
+	section := []byte{0, tableID, 0xb0 | byte(n>>8), byte(n)}
+	section = append(section, body...)
+	return append(section, 0xde, 0xad, 0xbe, 0xef)
+}
+
+// tsPackets splits a payload into TS packets, padding the last one with
+// adaptation field stuffing
+func tsPackets(pid int, start bool, payload []byte) []byte {
+	var out []byte
+	for first := true; first || len(payload) > 0; first = false {
+		pkt := []byte{tsSyncByte, byte(pid >> 8 & 0x1f), byte(pid), 0x10}
+		if first && start {
+			pkt[1] |= 0x40
+		}
+		n := min(len(payload), tsPacketSize-4)
+		if stuffing := tsPacketSize - 4 - n; stuffing > 0 {
+			pkt[3] = 0x30
+			pkt = append(pkt, byte(stuffing-1))
+			if stuffing > 1 {
+				pkt = append(pkt, 0)
+				pkt = append(pkt, bytes.Repeat([]byte{0xff}, stuffing-2)...)
+			}
+		}
+		pkt = append(pkt, payload[:n]...)
+		payload = payload[n:]
+		out = append(out, pkt...)
+	}
+	return out
+}
+
+// MP4 reading
+
+type mp4Box struct {
+	typ     string
+	offset  int // within the parent payload
+	payload []byte
+}
+
+func children(t *testing.T, data []byte) []mp4Box {
+	t.Helper()
+	var boxes []mp4Box
+	for off := 0; off < len(data); {
+		if len(data)-off < 8 {
+			t.Fatalf("truncated box header at %d", off)
+		}
+		size, header := int(binary.BigEndian.Uint32(data[off:])), 8
+		if size == 1 {
+			size, header = int(binary.BigEndian.Uint64(data[off+8:])), 16
+		}
+		if size < header || off+size > len(data) {
+			t.Fatalf("box %q at %d: size %d overruns %d bytes", data[off+4:off+8], off, size, len(data)-off)
+		}
+		boxes = append(boxes, mp4Box{typ: string(data[off+4 : off+8]), offset: off, payload: data[off+header : off+size]})
+		off += size
+	}
+	return boxes
+}
+
+func all(t *testing.T, data []byte, typ string) [][]byte {
+	t.Helper()
+	var found [][]byte
+	for _, b := range children(t, data) {
+		if b.typ == typ {
+			found = append(found, b.payload)
+		}
+	}
+	return found
+}
+
+// child returns the payload of the first box along path
+func child(t *testing.T, data []byte, path ...string) []byte {
+	t.Helper()
+	for _, typ := range path {
+		found := all(t, data, typ)
+		if len(found) == 0 {
+			t.Fatalf("no %s box in %v", typ, boxTypes(children(t, data)))
+		}
+		data = found[0]
+	}
+	return data
+}
+
+func boxTypes(boxes []mp4Box) []string {
+	var types []string
+	for _, b := range boxes {
+		types = append(types, b.typ)
+	}
+	return types
+}
+
+type trun struct {
+	dataOffset int
+	size       int
+	durations  []uint32
+	sync       []bool
+	cto        uint32 // of the last sample
+}
+
+func parseTrun(t *testing.T, b []byte, video bool) trun {
+	t.Helper()
+	count := int(binary.BigEndian.Uint32(b[4:]))
+	run := trun{dataOffset: int(int32(binary.BigEndian.Uint32(b[8:])))}
+	entry := 12
+	if video {
+		entry = 16
+	}
+	if len(b) != 12+count*entry {
+		t.Fatalf("trun of %d samples is %d bytes", count, len(b))
+	}
+	for i := 0; i < count; i++ {
+		e := b[12+i*entry:]
+		run.durations = append(run.durations, binary.BigEndian.Uint32(e))
+		run.size += int(binary.BigEndian.Uint32(e[4:]))
+		run.sync = append(run.sync, binary.BigEndian.Uint32(e[8:]) == flagsSync)
+		if video {
+			run.cto = binary.BigEndian.Uint32(e[12:])
+		}
+	}
+	return run
+}
+
+type table struct {
+	count    int
+	duration uint64
+	size     int64
+	sync     []uint32
+	ctts     bool
+	edit     uint32 // empty edit, in ms
+}
+
+// parseTable reads the sample table of a progressive track and checks that
+// its chunks lie within mdat
+func parseTable(t *testing.T, trak, file []byte, mdat mp4Box) table {
+	t.Helper()
+	stbl := child(t, trak, "mdia", "minf", "stbl")
+	var tab table
+
+	stts := child(t, stbl, "stts")
+	for i := 0; i < int(binary.BigEndian.Uint32(stts[4:])); i++ {
+		count, delta := binary.BigEndian.Uint32(stts[8+i*8:]), binary.BigEndian.Uint32(stts[12+i*8:])
+		tab.duration += uint64(count) * uint64(delta)
+	}
+	stsz := child(t, stbl, "stsz")
+	tab.count = int(binary.BigEndian.Uint32(stsz[8:]))
+	for i := 0; i < tab.count; i++ {
+		tab.size += int64(binary.BigEndian.Uint32(stsz[12+i*4:]))
+	}
+	for _, b := range children(t, stbl) {
+		switch b.typ {
+		case "stss":
+			for i := 0; i < int(binary.BigEndian.Uint32(b.payload[4:])); i++ {
+				tab.sync = append(tab.sync, binary.BigEndian.Uint32(b.payload[8+i*4:]))
+			}
+		case "ctts":
+			tab.ctts = true
+		}
+	}
+
+	stco := child(t, stbl, "stco")
+	mdatStart := len(file) - len(mdat.payload)
+	for i := 0; i < int(binary.BigEndian.Uint32(stco[4:])); i++ {
+		if off := int(binary.BigEndian.Uint32(stco[8+i*4:])); off < mdatStart || off >= len(file) {
+			t.Errorf("chunk %d at %d is outside mdat at %d", i, off, mdatStart)
+		}
+	}
+
+	for _, b := range children(t, trak) {
+		if b.typ == "edts" {
+			elst := child(t, b.payload, "elst")
+			if binary.BigEndian.Uint32(elst[12:]) == 0xffffffff {
+				tab.edit = binary.BigEndian.Uint32(elst[8:])
+			}
+		}
+	}
+	return tab
+}
@@ -0,0 +1,218 @@
+package remux
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+
+	// Stream types from the program map table
+	streamTypeAAC  = 0x0F
+	streamTypeH264 = 0x1B
+
+	// PTS and DTS are 33-bit counters at 90 kHz
+	tsClock     = 90000
+	ptsWrap     = int64(1) << 33
+	ptsHalfWrap = int64(1) << 32
+)
+
+var errNoSync = errors.New("remux: lost MPEG-TS sync")
+
+// pes is a reassembled packetized elementary stream packet
+type pes struct {
+	pts  int64 // 90 kHz
+	dts  int64 // equal to pts when the packet carries none
+	data []byte
+}
+
+// demuxer extracts the H.264 and AAC elementary streams of the first
+// program in an MPEG-TS. Program tables are remembered across segments.
+type demuxer struct {
+	pmtPID   int
+	videoPID int
+	audioPID int
+}
+
+func newDemuxer() *demuxer {
+	return &demuxer{pmtPID: -1, videoPID: -1, audioPID: -1}
+}
+
+// segment demuxes one self-contained TS segment into its video and audio
+// PES packets, in stream order
+func (d *demuxer) segment(data []byte) (video, audio []pes, err error) {
+	var videoBuf, audioBuf []byte
+
+	flush := func(buf []byte, out *[]pes) error {
+		if len(buf) == 0 {
+			return nil
+		}
+		p, err := parsePES(buf)
+		if err != nil {
+			return err
+		}
+		*out = append(*out, p)
+		return nil
+	}
+
+	for off := 0; off+tsPacketSize <= len(data); off += tsPacketSize {
+		pkt := data[off : off+tsPacketSize]
+		if pkt[0] != tsSyncByte {
+			return nil, nil, errNoSync
+		}
+
+		start := pkt[1]&0x40 != 0
+		pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+		adaptation := (pkt[3] >> 4) & 0x3
+
+		payload := pkt[4:]
+		if adaptation&0x2 != 0 {
+			n := int(payload[0]) + 1
+			if n > len(payload) {
+				continue
+			}
+			payload = payload[n:]
+		}
+		if adaptation&0x1 == 0 {
+			continue
+		}
+
+		switch {
+		case pid == 0 && start:
+			d.parsePAT(payload)
+		case pid == d.pmtPID && start:
+			d.parsePMT(payload)
+		case pid == d.videoPID:
+			if start {
+				if err := flush(videoBuf, &video); err != nil {
+					return nil, nil, err
+				}
+				videoBuf = nil
+			}
+			videoBuf = append(videoBuf, payload...)
+		case pid == d.audioPID:
+			if start {
+				if err := flush(audioBuf, &audio); err != nil {
+					return nil, nil, err
+				}
+				audioBuf = nil
+			}
+			audioBuf = append(audioBuf, payload...)
+		}
+	}
+
+	if err := flush(videoBuf, &video); err != nil {
+		return nil, nil, err
+	}
+	if err := flush(audioBuf, &audio); err != nil {
+		return nil, nil, err
+	}
+	return video, audio, nil
+}
+
+// psiSection skips the pointer field and returns the section body
+// between the header and the CRC
+func psiSection(payload []byte, headerLen int) []byte {
+	if len(payload) < 1 {
+		return nil
+	}
+	p := payload[1:]
+	if int(payload[0]) > len(p) {
+		return nil
+	}
+	p = p[payload[0]:]
+	if len(p) < 3 {
+		return nil
+	}
+	end := 3 + (int(p[1]&0x0f)<<8 | int(p[2])) - 4
+	if end > len(p) || end < headerLen {
+		return nil
+	}
+	return p[headerLen:end]
+}
+
+func (d *demuxer) parsePAT(payload []byte) {
+	programs := psiSection(payload, 8)
+	for i := 0; i+4 <= len(programs); i += 4 {
+		number := int(programs[i])<<8 | int(programs[i+1])
+		if number != 0 {
+			d.pmtPID = int(programs[i+2]&0x1f)<<8 | int(programs[i+3])
+			return
+		}
+	}
+}
+
+func (d *demuxer) parsePMT(payload []byte) {
+	if len(payload) < 1 || int(payload[0])+13 > len(payload) {
+		return
+	}
+	p := payload[1+payload[0]:]
+	infoLen := int(p[10]&0x0f)<<8 | int(p[11])
+
+	streams := psiSection(payload, 12+infoLen)
+	for i := 0; i+5 <= len(streams); {
+		streamType := streams[i]
+		pid := int(streams[i+1]&0x1f)<<8 | int(streams[i+2])
+		esInfoLen := int(streams[i+3]&0x0f)<<8 | int(streams[i+4])
+
+		switch {
+		case streamType == streamTypeH264 && d.videoPID < 0:
+			d.videoPID = pid
+		case streamType == streamTypeAAC && d.audioPID < 0:
+			d.audioPID = pid
+		}
+		i += 5 + esInfoLen
+	}
+}
+
+// parsePES parses a PES header and returns the packet timestamps and payload
+func parsePES(buf []byte) (pes, error) {
+	if len(buf) < 9 || buf[0] != 0 || buf[1] != 0 || buf[2] != 1 {
+		return pes{}, fmt.Errorf("remux: invalid PES start code")
+	}
+
+	flags := buf[7] >> 6
+	headerLen := 9 + int(buf[8])
+	if headerLen > len(buf) {
+		return pes{}, fmt.Errorf("remux: truncated PES header")
+	}
+
+	var p pes
+	if flags&0x2 != 0 {
+		if len(buf) < 14 {
+			return pes{}, fmt.Errorf("remux: truncated PTS")
+		}
+		p.pts = parseTimestamp(buf[9:14])
+		p.dts = p.pts
+	}
+	if flags == 0x3 {
+		if len(buf) < 19 {
+			return pes{}, fmt.Errorf("remux: truncated DTS")
+		}
+		p.dts = parseTimestamp(buf[14:19])
+	}
+	p.data = buf[headerLen:]
+	return p, nil
+}
+
+func parseTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 |
+		int64(b[1])<<22 |
+		int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 |
+		int64(b[4]>>1)
+}
+
+// unwrap extends a 33-bit timestamp to the value closest to prev
+func unwrap(prev, ts int64) int64 {
+	ts += prev &^ (ptsWrap - 1)
+	switch {
+	case ts < prev-ptsHalfWrap:
+		ts += ptsWrap
+	case ts > prev+ptsHalfWrap:
+		ts -= ptsWrap
+	}
+	return ts
+}
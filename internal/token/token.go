@@ -1,6 +1,7 @@
 package token
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
@@ -28,19 +29,21 @@ type TokenCache struct {
 	httpClient  *http.Client
 }
 
-func NewCache(upstreamAPI, magicKey string) *TokenCache {
+// NewCache creates a token cache. A nil transport uses http.DefaultTransport.
+func NewCache(upstreamAPI, magicKey string, transport http.RoundTripper) *TokenCache {
 	return &TokenCache{
 		cache:       make(map[string]cacheEntry),
 		upstreamAPI: upstreamAPI,
 		magicKey:    magicKey,
 		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
+			Timeout:   10 * time.Second,
+			Transport: transport,
 		},
 	}
 }
 
 // GetVideoToken returns a cached video token or fetches a new one
-func (tc *TokenCache) GetVideoToken(loginToken string) (string, error) {
+func (tc *TokenCache) GetVideoToken(ctx context.Context, loginToken string) (string, error) {
 	tc.mu.RLock()
 	entry, ok := tc.cache[loginToken]
 	tc.mu.RUnlock()
@@ -50,7 +53,7 @@ func (tc *TokenCache) GetVideoToken(loginToken string) (string, error) {
 	}
 
 	// Fetch new token
-	videoToken, err := tc.fetchVideoToken(loginToken)
+	videoToken, err := tc.fetchVideoToken(ctx, loginToken)
 	if err != nil {
 		return "", err
 	}
@@ -73,10 +76,10 @@ func (tc *TokenCache) InvalidateToken(loginToken string) {
 	tc.mu.Unlock()
 }
 
-func (tc *TokenCache) fetchVideoToken(loginToken string) (string, error) {
+func (tc *TokenCache) fetchVideoToken(ctx context.Context, loginToken string) (string, error) {
 	url := tc.upstreamAPI + "/v1/auth/video/token?id=0"
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return "", err
 	}